@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/audit"
+)
+
+const (
+	defaultStatsDays  = 7
+	defaultStatsLimit = 50
+	maxStatsLimit     = 1000
+)
+
+type OriginStatsResponse struct {
+	SinceTs int64                `json:"since_ts"`
+	Origins []*audit.OriginStats `json:"origins"`
+}
+
+type SearchStatsResponse struct {
+	SinceTs  int64                `json:"since_ts"`
+	Searches []*audit.SearchStats `json:"searches"`
+}
+
+// GetOriginStats lists the servers which have used the directory the most.
+func (h *Handlers) GetOriginStats(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.Token); res != nil {
+		return res
+	}
+
+	since, limit, errRes := statsParams(r)
+	if errRes != nil {
+		return errRes
+	}
+	origins, err := h.Audit.Origins(r.Context(), since, limit)
+	if err != nil {
+		log.Error("Error reading audit log: ", err)
+		return common.InternalServerError("failed to read the audit log")
+	}
+	return &OriginStatsResponse{SinceTs: since.UnixMilli(), Origins: origins}
+}
+
+// GetSearchStats lists the most common searches of the directory.
+func (h *Handlers) GetSearchStats(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.Token); res != nil {
+		return res
+	}
+
+	since, limit, errRes := statsParams(r)
+	if errRes != nil {
+		return errRes
+	}
+	searches, err := h.Audit.TopSearches(r.Context(), since, limit)
+	if err != nil {
+		log.Error("Error reading audit log: ", err)
+		return common.InternalServerError("failed to read the audit log")
+	}
+	return &SearchStatsResponse{SinceTs: since.UnixMilli(), Searches: searches}
+}
+
+// statsParams reads the days and limit query parameters.
+func statsParams(r *http.Request) (time.Time, int, *common.ErrorResponse) {
+	days := defaultStatsDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 {
+			return time.Time{}, 0, common.BadRequestError("days must be a positive number")
+		}
+		days = v
+	}
+
+	limit := defaultStatsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 1 || v > maxStatsLimit {
+			return time.Time{}, 0, common.BadRequestError("limit must be between 1 and " + strconv.Itoa(maxStatsLimit))
+		}
+		limit = v
+	}
+
+	return time.Now().AddDate(0, 0, -days), limit, nil
+}
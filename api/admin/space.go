@@ -0,0 +1,236 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/audit"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/matrix"
+)
+
+type SpaceChildRequest struct {
+	Via       []string `json:"via"`
+	Order     *string  `json:"order"`
+	Suggested *bool    `json:"suggested"`
+
+	// SetParent also sends an m.space.parent event in the room, which needs the bot to
+	// have permission to send state events there.
+	SetParent bool `json:"set_parent"`
+}
+
+type SpaceChildResponse struct {
+	RoomId  string                 `json:"room_id"`
+	Content map[string]interface{} `json:"content"`
+
+	// Refreshed is false if the change was made, but updating the directory failed. The
+	// change will show up on the next scheduled update instead.
+	Refreshed bool `json:"refreshed"`
+}
+
+type ReorderRequest struct {
+	Rooms []string `json:"rooms"`
+}
+
+type RefreshResponse struct {
+	Refreshed bool `json:"refreshed"`
+}
+
+// Handlers serves the admin API for a directory.
+type Handlers struct {
+	Token     string
+	Directory *directory.Service
+
+	// Audit is only required when the audit log is enabled
+	Audit *audit.Log
+}
+
+// PutSpaceChild adds a room to the space, or changes its order, suggested flag or via
+// servers if it is already there.
+func (h *Handlers) PutSpaceChild(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.Token); res != nil {
+		return res
+	}
+
+	req := SpaceChildRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return common.BadJsonError(err.Error())
+	}
+	if req.Order != nil && !isValidOrder(*req.Order) {
+		return common.BadRequestError("order must be at most 50 printable ASCII characters")
+	}
+
+	roomId, res := h.resolve(r, log)
+	if res != nil {
+		return res
+	}
+
+	content, err := h.Directory.UpdateSpaceChild(r.Context(), roomId, directory.SpaceChildUpdate{
+		Via:       req.Via,
+		Order:     req.Order,
+		Suggested: req.Suggested,
+	})
+	if err != nil {
+		log.Error("Error updating space child: ", err)
+		return matrixError(err, "unable to update the space")
+	}
+
+	if req.SetParent {
+		err = h.Directory.SetSpaceParent(r.Context(), roomId)
+		if err != nil {
+			log.Error("Error setting space parent: ", err)
+			return matrixError(err, "the room was added to the space, but its parent could not be set")
+		}
+	}
+
+	return &SpaceChildResponse{
+		RoomId:    roomId,
+		Content:   content,
+		Refreshed: h.refresh(log),
+	}
+}
+
+// DeleteSpaceChild removes a room from the space. With ?remove_parent=true the room's
+// m.space.parent event is removed too.
+func (h *Handlers) DeleteSpaceChild(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.Token); res != nil {
+		return res
+	}
+
+	roomId, res := h.resolve(r, log)
+	if res != nil {
+		return res
+	}
+
+	err := h.Directory.RemoveSpaceChild(r.Context(), roomId)
+	if err != nil {
+		log.Error("Error removing space child: ", err)
+		return matrixError(err, "unable to update the space")
+	}
+
+	if r.URL.Query().Get("remove_parent") == "true" {
+		err = h.Directory.RemoveSpaceParent(r.Context(), roomId)
+		if err != nil {
+			log.Error("Error removing space parent: ", err)
+			return matrixError(err, "the room was removed from the space, but its parent could not be removed")
+		}
+	}
+
+	return &SpaceChildResponse{
+		RoomId:    roomId,
+		Content:   map[string]interface{}{},
+		Refreshed: h.refresh(log),
+	}
+}
+
+// PutSpaceOrder lists the given rooms first, in the given order.
+func (h *Handlers) PutSpaceOrder(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.Token); res != nil {
+		return res
+	}
+
+	req := ReorderRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return common.BadJsonError(err.Error())
+	}
+	if len(req.Rooms) == 0 {
+		return common.BadRequestError("rooms must list at least one room")
+	}
+
+	roomIds := make([]string, 0, len(req.Rooms))
+	for _, room := range req.Rooms {
+		roomId, err := h.Directory.Client().ResolveRoom(r.Context(), room)
+		if err != nil {
+			return common.BadRequestError(room + " could not be resolved")
+		}
+		roomIds = append(roomIds, roomId)
+	}
+
+	err = h.Directory.ReorderSpaceChildren(r.Context(), roomIds)
+	if errors.Is(err, directory.ErrNotInSpace) {
+		return common.BadRequestError(err.Error())
+	}
+	if err != nil {
+		log.Error("Error reordering space: ", err)
+		return matrixError(err, "unable to reorder the space")
+	}
+
+	return &RefreshResponse{Refreshed: h.refresh(log)}
+}
+
+// PostRefresh updates the directory immediately.
+func (h *Handlers) PostRefresh(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.Token); res != nil {
+		return res
+	}
+	return &RefreshResponse{Refreshed: h.refresh(log)}
+}
+
+func (h *Handlers) resolve(r *http.Request, log *logrus.Entry) (string, *common.ErrorResponse) {
+	room := mux.Vars(r)["room"]
+	if !strings.HasPrefix(room, "#") && !strings.HasPrefix(room, "!") {
+		return "", common.BadRequestError("room must be a room alias or room ID")
+	}
+
+	roomId, err := h.Directory.Client().ResolveRoom(r.Context(), room)
+	if err != nil {
+		log.Warn("Error resolving room: ", err)
+		return "", common.BadRequestError(room + " could not be resolved")
+	}
+	return roomId, nil
+}
+
+func (h *Handlers) refresh(log *logrus.Entry) bool {
+	err := h.Directory.DoUpdate()
+	if err != nil {
+		log.Error("Error updating directory after change: ", err)
+		return false
+	}
+	return true
+}
+
+// matrixError passes on the homeserver's refusal when it's the bot's permissions at
+// fault, and is an internal error otherwise.
+func matrixError(err error, message string) *common.ErrorResponse {
+	var matrixErr *matrix.Error
+	if errors.As(err, &matrixErr) && matrixErr.ErrCode == matrix.ErrCodeForbidden {
+		return common.ForbiddenError("The homeserver refused the change: " + matrixErr.Message)
+	}
+	return common.InternalServerError(message)
+}
+
+// isValidOrder checks an m.space.child order against the spec's rules.
+func isValidOrder(order string) bool {
+	if len(order) > 50 {
+		return false
+	}
+	for _, c := range order {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appservice
+
+import (
+	"container/list"
+	"sync"
+)
+
+// maxRememberedTransactions is how many transaction IDs are remembered. The homeserver
+// retries a transaction until it succeeds before sending the next, so only recent IDs
+// can be sent again.
+const maxRememberedTransactions = 1000
+
+// transactionLog remembers the most recently handled transaction IDs.
+type transactionLog struct {
+	lock  sync.Mutex
+	order *list.List
+	ids   map[string]*list.Element
+}
+
+func newTransactionLog() *transactionLog {
+	return &transactionLog{
+		order: list.New(),
+		ids:   make(map[string]*list.Element),
+	}
+}
+
+// markHandled records the transaction ID, returning false if it had already been
+// recorded.
+func (l *transactionLog) markHandled(txnId string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if el, ok := l.ids[txnId]; ok {
+		l.order.MoveToFront(el)
+		return false
+	}
+
+	l.ids[txnId] = l.order.PushFront(txnId)
+	if l.order.Len() > maxRememberedTransactions {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.ids, oldest.Value.(string))
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appservice
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/matrix"
+)
+
+// directoryStateTypes are the state events which change how a room is listed.
+var directoryStateTypes = map[string]bool{
+	"m.space.child":             true,
+	"m.room.tombstone":          true,
+	"m.room.name":               true,
+	"m.room.topic":              true,
+	"m.room.avatar":             true,
+	"m.room.canonical_alias":    true,
+	"m.room.join_rules":         true,
+	"m.room.history_visibility": true,
+	"m.room.guest_access":       true,
+}
+
+// EventHandler is given every event the homeserver sends.
+type EventHandler interface {
+	HandleEvent(ev *matrix.Event)
+}
+
+// Handlers serves the appservice API the homeserver pushes events to.
+type Handlers struct {
+	HsToken   string
+	Directory *directory.Service
+
+	// Events is optional
+	Events EventHandler
+
+	transactions *transactionLog
+}
+
+func NewHandlers(hsToken string, dir *directory.Service) *Handlers {
+	return &Handlers{
+		HsToken:      hsToken,
+		Directory:    dir,
+		transactions: newTransactionLog(),
+	}
+}
+
+type transaction struct {
+	Events []*matrix.Event `json:"events"`
+}
+
+// PutTransaction receives events from the homeserver, updating the directory when a
+// room in it changes. Transactions the homeserver retries after they were handled are
+// acknowledged without handling their events again, so that bot commands don't run twice.
+func (h *Handlers) PutTransaction(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.HsToken); res != nil {
+		return res
+	}
+
+	txn := transaction{}
+	err := json.NewDecoder(r.Body).Decode(&txn)
+	if err != nil {
+		return common.BadJsonError(err.Error())
+	}
+
+	txnId := mux.Vars(r)["txnId"]
+	if !h.transactions.markHandled(txnId) {
+		log.WithField("txn_id", txnId).Info("Ignoring transaction which was already handled")
+		return &common.EmptyResponse{}
+	}
+
+	snapshot := h.Directory.Current()
+	updateRequested := false
+	for _, ev := range txn.Events {
+		if h.Events != nil {
+			h.Events.HandleEvent(ev)
+		}
+
+		if updateRequested || !ev.IsState() || !directoryStateTypes[ev.Type] {
+			continue
+		}
+		if ev.RoomId != h.Directory.SpaceId() && snapshot.Room(ev.RoomId) == nil {
+			continue
+		}
+
+		log.WithFields(logrus.Fields{
+			"room_id":    ev.RoomId,
+			"event_type": ev.Type,
+		}).Info("Room in the directory changed, requesting update")
+		h.Directory.RequestUpdate()
+		updateRequested = true
+	}
+
+	return &common.EmptyResponse{}
+}
+
+// NotFound answers the homeserver's user and alias queries: the appservice doesn't
+// provide any users or aliases.
+func (h *Handlers) NotFound(r *http.Request, log *logrus.Entry) interface{} {
+	if res := common.RequireToken(r, h.HsToken); res != nil {
+		return res
+	}
+	return common.NotFoundError()
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// RequireToken checks the request carries the given token, either as a bearer token
+// or in the access_token query parameter. It returns the error to reply with if not.
+func RequireToken(r *http.Request, token string) *ErrorResponse {
+	given := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		given = strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	if given == "" {
+		return UnauthorizedError()
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return ForbiddenError("Invalid access token")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingBrotli   = "br"
+)
+
+// CachedResponse is a pre-encoded body which clients may cache until MaxAge has passed,
+// and then revalidate with its ETag.
+type CachedResponse struct {
+	ETag   string
+	MaxAge time.Duration
+	Body   *EncodedBody
+}
+
+// EncodedBody is a response body which has already been encoded, so it can be sent
+// many times. Compressed forms are made the first time they're asked for and kept.
+type EncodedBody struct {
+	ContentType string
+
+	raw        []byte
+	lock       sync.Mutex
+	compressed map[string][]byte
+}
+
+func NewEncodedBody(contentType string, raw []byte) *EncodedBody {
+	return &EncodedBody{ContentType: contentType, raw: raw, compressed: make(map[string][]byte)}
+}
+
+// EncodeJson encodes v as the body of a JSON response.
+func EncodeJson(v interface{}) (*EncodedBody, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return NewEncodedBody("application/json", b), nil
+}
+
+// Bytes returns the body with the given content encoding.
+func (b *EncodedBody) Bytes(encoding string) []byte {
+	if encoding == EncodingIdentity {
+		return b.raw
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if c, ok := b.compressed[encoding]; ok {
+		return c
+	}
+
+	buf := &bytes.Buffer{}
+	w := Compress(buf, encoding)
+	_, _ = w.Write(b.raw) // writes to a bytes.Buffer can't fail
+	_ = w.Close()
+	b.compressed[encoding] = buf.Bytes()
+	return buf.Bytes()
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Compress wraps w so that anything written is compressed with the given content
+// encoding. The returned writer must be closed to flush the compressed data. It also has
+// a Flush method, which sends what has been written so far on to w, and flushes w if
+// it's an http.Flusher.
+func Compress(w io.Writer, encoding string) io.WriteCloser {
+	switch encoding {
+	case EncodingBrotli:
+		return &flushWriteCloser{brotli.NewWriterLevel(w, brotli.DefaultCompression), w}
+	case EncodingGzip:
+		return &flushWriteCloser{gzip.NewWriter(w), w}
+	default:
+		return &flushWriteCloser{nopWriteCloser{w}, w}
+	}
+}
+
+type flushWriteCloser struct {
+	io.WriteCloser
+	dst io.Writer
+}
+
+func (w *flushWriteCloser) Flush() {
+	// Both compressors flush this way, so streamed responses aren't held back until they
+	// fill the compressor's buffer
+	if f, ok := w.WriteCloser.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.dst.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// NegotiateEncoding picks the content encoding to reply with from an Accept-Encoding
+// header, preferring brotli over gzip.
+func NegotiateEncoding(acceptEncoding string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		accepted[name] = q > 0
+	}
+
+	for _, encoding := range []string{EncodingBrotli, EncodingGzip} {
+		if ok, listed := accepted[encoding]; ok || (!listed && accepted["*"]) {
+			return encoding
+		}
+	}
+	return EncodingIdentity
+}
+
+// MatchesETag returns true if an If-None-Match header matches the given ETag.
+func MatchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the memory used by a RateLimiter. Once reached, clients which
+// have used none of their allowance are forgotten.
+const maxTrackedClients = 10000
+
+// RateLimiter allows each client a burst of requests, refilling one request every
+// interval.
+type RateLimiter struct {
+	burst    int
+	interval time.Duration
+
+	lock    sync.Mutex
+	clients map[string]*bucket
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(burst int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		burst:    burst,
+		interval: interval,
+		clients:  make(map[string]*bucket),
+	}
+}
+
+// SetLimit changes the burst and interval. Clients keep what they have left of their
+// allowance, up to the new burst.
+func (l *RateLimiter) SetLimit(burst int, interval time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.burst = burst
+	l.interval = interval
+}
+
+// Allow takes a request from the client's allowance. If there is none left, it returns
+// false and how long until there will be.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	b, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= maxTrackedClients {
+			l.forgetIdle(now)
+		}
+		b = &bucket{tokens: float64(l.burst), updated: now}
+		l.clients[client] = b
+	}
+	b.refill(now, l.burst, l.interval)
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) * float64(l.interval))
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (b *bucket) refill(now time.Time, burst int, interval time.Duration) {
+	b.tokens += float64(now.Sub(b.updated)) / float64(interval)
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.updated = now
+}
+
+func (l *RateLimiter) forgetIdle(now time.Time) {
+	for client, b := range l.clients {
+		b.refill(now, l.burst, l.interval)
+		if b.tokens >= float64(l.burst) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// ClientIp returns the IP address a request came from. Requests arriving through a
+// reverse proxy on the same machine (over loopback or a Unix socket) are attributed to
+// the last address in X-Forwarded-For instead, which is the one the proxy added. Earlier
+// addresses are supplied by the client, so can't be trusted.
+func ClientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() {
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			if last := strings.TrimSpace(addresses[len(addresses)-1]); last != "" {
+				return last
+			}
+		}
+	}
+	return host
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClientIp(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expected   string
+	}{
+		{"direct", "203.0.113.7:1234", nil, "203.0.113.7"},
+		{"direct ignores forwarded", "203.0.113.7:1234", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"loopback proxy", "127.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"unix socket proxy", "@", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"fake leading entry", "127.0.0.1:1234", []string{"192.0.2.99, 198.51.100.1"}, "198.51.100.1"},
+		{"fake leading header", "[::1]:1234", []string{"192.0.2.99", "198.51.100.1"}, "198.51.100.1"},
+		{"loopback without forwarded", "127.0.0.1:1234", nil, "127.0.0.1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/submissions", nil)
+			r.RemoteAddr = c.remoteAddr
+			for _, f := range c.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			if actual := ClientIp(r); actual != c.expected {
+				t.Errorf("expected %s, got %s", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(2, time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d was limited within the burst", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("a")
+	if ok || retryAfter <= 0 || retryAfter > time.Hour {
+		t.Errorf("expected the third request to be limited, got %v with retry after %s", ok, retryAfter)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("another client was limited")
+	}
+}
+
+func TestRateLimiterSetLimit(t *testing.T) {
+	l := NewRateLimiter(1, time.Hour)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first request was limited")
+	}
+
+	// A shorter interval refills the client's allowance sooner
+	l.SetLimit(1, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("expected the new interval to apply to an existing client")
+	}
+
+	// A bigger burst lets new clients make more requests at once
+	l.SetLimit(3, time.Hour)
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("b"); !ok {
+			t.Fatalf("request %d was limited within the new burst", i+1)
+		}
+	}
+}
@@ -17,17 +17,63 @@
 package common
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
+	"time"
 )
 
 type EmptyResponse struct{}
 
+// RawResponse is sent to the client as-is rather than being encoded as JSON.
+type RawResponse struct {
+	ContentType string
+	HttpStatus  int
+	// Write is given a writer with a Flush method, which sends what has been written so
+	// far to the client.
+	Write func(w io.Writer) error
+}
+
+// JsonResponse encodes the value as JSON with the given status code, for successful
+// responses which aren't a 200.
+func JsonResponse(httpStatus int, v interface{}) *RawResponse {
+	return &RawResponse{
+		ContentType: "application/json",
+		HttpStatus:  httpStatus,
+		Write: func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(v)
+		},
+	}
+}
+
 type ErrorResponse struct {
 	Code       string `json:"errcode"`
 	Message    string `json:"error"`
 	HttpStatus int    `json:"http_status"`
 }
 
+// RateLimitedResponse is an ErrorResponse telling the client how long to wait before
+// trying again.
+type RateLimitedResponse struct {
+	ErrorResponse
+	RetryAfterMs int64 `json:"retry_after_ms"`
+}
+
+func BadRequestError(message string) *ErrorResponse {
+	return &ErrorResponse{"M_INVALID_PARAM", message, http.StatusBadRequest}
+}
+
+func BadJsonError(message string) *ErrorResponse {
+	return &ErrorResponse{"M_BAD_JSON", message, http.StatusBadRequest}
+}
+
+func RateLimitedError(retryAfter time.Duration) *RateLimitedResponse {
+	return &RateLimitedResponse{
+		ErrorResponse: ErrorResponse{"M_LIMIT_EXCEEDED", "Too many requests", http.StatusTooManyRequests},
+		RetryAfterMs:  retryAfter.Milliseconds(),
+	}
+}
+
 func InternalServerError(message string) *ErrorResponse {
 	return &ErrorResponse{"M_UNKNOWN", message, http.StatusInternalServerError}
 }
@@ -39,3 +85,11 @@ func MethodNotAllowed() *ErrorResponse {
 func NotFoundError() *ErrorResponse {
 	return &ErrorResponse{"M_NOT_FOUND", "Resource Not Found", http.StatusNotFound}
 }
+
+func UnauthorizedError() *ErrorResponse {
+	return &ErrorResponse{"M_UNAUTHORIZED", "Missing access token", http.StatusUnauthorized}
+}
+
+func ForbiddenError(message string) *ErrorResponse {
+	return &ErrorResponse{"M_FORBIDDEN", message, http.StatusForbidden}
+}
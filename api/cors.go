@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/config"
+)
+
+// The methods and headers allowed by the client-server API spec's CORS recommendations.
+const (
+	corsAllowedMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowedHeaders = "X-Requested-With, Content-Type, Authorization"
+)
+
+// corsHandler adds CORS headers to every response, and answers preflight requests for
+// any route.
+type corsHandler struct {
+	next      http.Handler
+	preflight http.Handler
+	anyOrigin bool
+	origins   map[string]bool
+	maxAge    string
+}
+
+func withCors(c config.CorsConfig, next http.Handler) http.Handler {
+	h := &corsHandler{
+		next:      next,
+		preflight: handler{corsPreflight, "cors_preflight"},
+		origins:   make(map[string]bool),
+		maxAge:    strconv.Itoa(int(c.MaxAge.Seconds())),
+	}
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			h.anyOrigin = true
+		}
+		h.origins[o] = true
+	}
+	return h
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if h.anyOrigin {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		// The response depends on the origin, so caches must keep them apart
+		w.Header().Add("Vary", "Origin")
+		if origin != "" && h.origins[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+	w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
+
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Max-Age", h.maxAge)
+		h.preflight.ServeHTTP(w, r)
+		return
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+func corsPreflight(r *http.Request, log *logrus.Entry) interface{} {
+	return &common.EmptyResponse{}
+}
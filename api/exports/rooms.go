@@ -0,0 +1,53 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package exports
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/export"
+)
+
+// Handlers serves exports of a directory.
+type Handlers struct {
+	Directory *directory.Service
+}
+
+func (h *Handlers) GetRooms(r *http.Request, log *logrus.Entry) interface{} {
+	format := mux.Vars(r)["format"]
+	if !export.ValidFormat(format) {
+		return common.NotFoundError()
+	}
+
+	fields, err := export.ParseFields(r.URL.Query().Get("fields"))
+	if err != nil {
+		return common.BadRequestError(err.Error())
+	}
+
+	rooms := h.Directory.Current().Rooms
+	return &common.RawResponse{
+		ContentType: export.ContentType(format),
+		Write: func(w io.Writer) error {
+			return export.Write(w, format, rooms, fields)
+		},
+	}
+}
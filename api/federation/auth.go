@@ -0,0 +1,60 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"context"
+	"strings"
+
+	"github.com/t2bot/matrix-room-directory-server/audit"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+)
+
+// Authenticator verifies the signature on incoming federation requests.
+type Authenticator interface {
+	CheckAuth(ctx context.Context, authHeader string, urlMethod string, urlWithQuery string, destinationHost string, body []byte) error
+}
+
+// Handlers serves the federation API from a directory, authenticating requests first.
+type Handlers struct {
+	Config    func() *config.Config
+	Auth      Authenticator
+	Directory *directory.Service
+
+	// Audit is optional, and records each authenticated request if set
+	Audit *audit.Log
+
+	pages pageCache
+}
+
+// originFromAuth extracts the origin server name from an X-Matrix Authorization header,
+// returning "unknown" if there isn't one. The header should already have been verified.
+func originFromAuth(authHeader string) string {
+	if !strings.HasPrefix(authHeader, "X-Matrix ") {
+		return "unknown"
+	}
+
+	for _, param := range strings.Split(authHeader[len("X-Matrix "):], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 && kv[0] == "origin" {
+			return strings.Trim(kv[1], "\"")
+		}
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package federation
+
+import (
+	"sync"
+
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+)
+
+// maxCachedPages limits how many pages are kept per snapshot, as every distinct search
+// is its own page.
+const maxCachedPages = 1000
+
+// cachedPage is an encoded page, along with how many rooms matched in total.
+type cachedPage struct {
+	body  *common.EncodedBody
+	total int
+}
+
+// pageCache keeps encoded /publicRooms responses for the current snapshot, so popular
+// pages aren't encoded again on every request. It is emptied whenever the snapshot
+// changes.
+type pageCache struct {
+	lock    sync.Mutex
+	version string
+	pages   map[string]*cachedPage
+}
+
+// get returns the page for key in the given snapshot version, building it if it isn't
+// cached.
+func (c *pageCache) get(version string, key string, build func() (*cachedPage, error)) (*cachedPage, error) {
+	c.lock.Lock()
+	if c.version != version {
+		c.version = version
+		c.pages = make(map[string]*cachedPage)
+	}
+	page, ok := c.pages[key]
+	c.lock.Unlock()
+	if ok {
+		return page, nil
+	}
+
+	// Built without the lock held, so a slow page doesn't hold up others. Concurrent
+	// requests for the same page may both build it, which is harmless.
+	page, err := build()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.version == version && len(c.pages) < maxCachedPages {
+		c.pages[key] = page
+	}
+	return page, nil
+}
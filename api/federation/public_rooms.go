@@ -17,17 +17,55 @@
 package federation
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/audit"
+	"github.com/t2bot/matrix-room-directory-server/config"
 	"github.com/t2bot/matrix-room-directory-server/directory"
-	"github.com/t2bot/matrix-room-directory-server/key_server"
+	"github.com/t2bot/matrix-room-directory-server/metrics"
 	"github.com/t2bot/matrix-room-directory-server/models"
 	"github.com/t2bot/matrix-room-directory-server/util"
-	"io/ioutil"
-	"net/http"
-	"strconv"
 )
 
+type PublicRoomsRequest struct {
+	Limit  int               `json:"limit"`
+	Since  string            `json:"since"`
+	Filter PublicRoomsFilter `json:"filter"`
+
+	// RawFilter is the filter as sent, for the audit log
+	RawFilter json.RawMessage `json:"-"`
+}
+
+func (r *PublicRoomsRequest) UnmarshalJSON(b []byte) error {
+	type plain PublicRoomsRequest
+	raw := struct {
+		plain
+		Filter json.RawMessage `json:"filter"`
+	}{}
+	err := json.Unmarshal(b, &raw)
+	if err != nil {
+		return err
+	}
+	*r = PublicRoomsRequest(raw.plain)
+	r.RawFilter = raw.Filter
+	if raw.Filter != nil {
+		return json.Unmarshal(raw.Filter, &r.Filter)
+	}
+	return nil
+}
+
+type PublicRoomsFilter struct {
+	GenericSearchTerm string `json:"generic_search_term"`
+}
+
 type PublicRoomsResponse struct {
 	Chunk           []*models.PublicRoomEntry `json:"chunk"`
 	NextBatchToken  string                    `json:"next_batch,omitempty"`
@@ -35,7 +73,8 @@ type PublicRoomsResponse struct {
 	TotalRoomsKnown int                       `json:"total_room_count_estimate"`
 }
 
-func GetPublicRooms(r *http.Request, log *logrus.Entry) interface{} {
+func (h *Handlers) GetPublicRooms(r *http.Request, log *logrus.Entry) interface{} {
+	start := time.Now()
 	auth := r.Header.Get("Authorization")
 	urlWithQuery := r.URL.Path + "?" + r.URL.RawQuery
 	destination := r.Host
@@ -52,38 +91,103 @@ func GetPublicRooms(r *http.Request, log *logrus.Entry) interface{} {
 		return common.InternalServerError("body not available")
 	}
 
-	err = key_server.Default.CheckAuth(auth, method, urlWithQuery, destination, b)
+	err = h.Auth.CheckAuth(r.Context(), auth, method, urlWithQuery, destination, b)
 	if err != nil {
 		log.Error(err)
 		return common.InternalServerError("failed to authenticate request or some other error")
 	}
-
-	rooms := directory.Cached
+	origin := originFromAuth(auth)
+	metrics.FederationRequests.WithLabelValues(origin).Inc()
 
 	limitRaw := r.URL.Query().Get("limit")
 	sinceRaw := r.URL.Query().Get("since")
+	searchTerm := ""
+	filter := ""
+
+	if r.Method == http.MethodPost && len(b) > 0 {
+		body := PublicRoomsRequest{}
+		err = json.Unmarshal(b, &body)
+		if err != nil {
+			log.Error(err)
+			return common.BadJsonError("failed to parse request body")
+		}
+		if body.Limit > 0 {
+			limitRaw = strconv.Itoa(body.Limit)
+		}
+		if body.Since != "" {
+			sinceRaw = body.Since
+		}
+		searchTerm = body.Filter.GenericSearchTerm
+		if body.RawFilter != nil && string(body.RawFilter) != "null" {
+			filter = string(body.RawFilter)
+		}
+	}
 
 	limit := 0
 	since := 0
 	if limitRaw != "" {
 		v, err := strconv.Atoi(limitRaw)
-		if err != nil {
-			log.Error(err)
-			return common.InternalServerError("failed to parse limit")
+		if err != nil || v < 0 {
+			return common.BadRequestError("limit must be a non-negative integer")
 		}
 		limit = v
 	}
 	if sinceRaw != "" {
 		v, err := strconv.Atoi(sinceRaw)
-		if err != nil {
-			log.Error(err)
-			return common.InternalServerError("failed to parse since")
+		if err != nil || v < 0 {
+			return common.BadRequestError("since must be a non-negative integer")
 		}
 		since = v
 	}
 
+	snapshot := h.Directory.Current()
+	searchConfig := h.Config().Search
+	key := fmt.Sprintf("%d|%d|%d|%g|%s", since, limit, searchConfig.FuzzyMaxEdits, searchConfig.FuzzyMinSimilarity, searchTerm)
+	page, err := h.pages.get(snapshot.Version, key, func() (*cachedPage, error) {
+		res := publicRoomsPage(snapshot, searchConfig, searchTerm, since, limit, log)
+		body, err := common.EncodeJson(res)
+		if err != nil {
+			return nil, err
+		}
+		return &cachedPage{body: body, total: res.TotalRoomsKnown}, nil
+	})
+	if err != nil {
+		log.Error(err)
+		return common.InternalServerError("failed to encode response")
+	}
+
+	if h.Audit != nil {
+		h.Audit.Record(&audit.Entry{
+			Origin:      origin,
+			Method:      r.Method,
+			Route:       "/_matrix/federation/v1/publicRooms",
+			SearchTerm:  searchTerm,
+			Filter:      filter,
+			ResultCount: page.total,
+			Latency:     time.Since(start),
+			Timestamp:   start,
+		})
+	}
+
+	return &common.CachedResponse{
+		ETag:   pageETag(snapshot.Version, key),
+		MaxAge: cacheMaxAge(snapshot),
+		Body:   page.body,
+	}
+}
+
+func publicRoomsPage(snapshot *directory.Snapshot, searchConfig config.SearchConfig, searchTerm string, since int, limit int, log *logrus.Entry) *PublicRoomsResponse {
+	rooms := snapshot.Rooms
+	if searchTerm != "" {
+		rooms = snapshot.Index.Search(searchTerm)
+		if len(rooms) == 0 {
+			rooms = snapshot.Index.FuzzySearch(searchTerm, searchConfig.FuzzyMaxEdits, searchConfig.FuzzyMinSimilarity)
+		}
+		log.WithField("search_term", searchTerm).Infof("Search matched %d rooms", len(rooms))
+	}
+
 	max := len(rooms)
-	start := since
+	start := util.Min(max, since)
 	end := util.Min(max, start+limit)
 	if end == start {
 		end = max
@@ -91,14 +195,18 @@ func GetPublicRooms(r *http.Request, log *logrus.Entry) interface{} {
 
 	subsetRooms := rooms[start:end]
 
+	// Tokens are the index of the first room on the page they lead to
 	nextToken := ""
 	if end != max {
-		nextToken = strconv.Itoa(end + 1)
+		nextToken = strconv.Itoa(end)
 	}
 
+	// Without a limit the page runs to the end, so the only page before it is the first
 	prevToken := ""
-	if start != 0 {
-		prevToken = strconv.Itoa(start - 1)
+	if start != 0 && limit > 0 {
+		prevToken = strconv.Itoa(util.Max(0, start-limit))
+	} else if start != 0 {
+		prevToken = "0"
 	}
 
 	return &PublicRoomsResponse{
@@ -108,3 +216,20 @@ func GetPublicRooms(r *http.Request, log *logrus.Entry) interface{} {
 		TotalRoomsKnown: len(rooms),
 	}
 }
+
+// pageETag identifies a page of a snapshot.
+func pageETag(version string, key string) string {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return fmt.Sprintf("\"%s-%s\"", version, strconv.FormatUint(h.Sum64(), 36))
+}
+
+// cacheMaxAge is how long a response from the snapshot can be cached for: until the
+// directory is next due to be refreshed.
+func cacheMaxAge(snapshot *directory.Snapshot) time.Duration {
+	remaining := time.Until(snapshot.UpdatedAt.Add(directory.RefreshInterval))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
@@ -0,0 +1,192 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package feeds
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+const feedTitle = "New rooms in the directory"
+
+// Handlers serves feeds of the changes to a directory.
+type Handlers struct {
+	Directory *directory.Service
+}
+
+type item struct {
+	Guid        string
+	Title       string
+	Link        string
+	Description string
+	Timestamp   time.Time
+}
+
+func (h *Handlers) GetAtomFeed(r *http.Request, log *logrus.Entry) interface{} {
+	items := h.feedItems(r)
+
+	feed := &atomFeed{
+		Xmlns:   "http://www.w3.org/2005/Atom",
+		Id:      h.tagUri("2022", "directory-feed"),
+		Title:   feedTitle,
+		Author:  atomAuthor{Name: h.serverName()},
+		Updated: h.lastUpdated(items).Format(time.RFC3339),
+		Link:    atomLink{Href: selfUrl(r), Rel: "self"},
+		Entries: make([]*atomEntry, len(items)),
+	}
+	for i, it := range items {
+		feed.Entries[i] = &atomEntry{
+			Id:      it.Guid,
+			Title:   it.Title,
+			Updated: it.Timestamp.Format(time.RFC3339),
+			Link:    atomLink{Href: it.Link, Rel: "alternate"},
+			Content: atomContent{Type: "html", Body: it.Description},
+		}
+	}
+
+	return writeXml("application/atom+xml; charset=utf-8", feed)
+}
+
+func (h *Handlers) GetRssFeed(r *http.Request, log *logrus.Entry) interface{} {
+	items := h.feedItems(r)
+
+	channel := &rssChannel{
+		Title:         feedTitle,
+		Link:          selfUrl(r),
+		Description:   feedTitle,
+		LastBuildDate: h.lastUpdated(items).Format(time.RFC1123Z),
+		Items:         make([]*rssItem, len(items)),
+	}
+	for i, it := range items {
+		channel.Items[i] = &rssItem{
+			Guid:        rssGuid{Value: it.Guid, IsPermaLink: false},
+			Title:       it.Title,
+			Link:        it.Link,
+			Description: it.Description,
+			PubDate:     it.Timestamp.Format(time.RFC1123Z),
+		}
+	}
+
+	return writeXml("application/rss+xml; charset=utf-8", &rssFeed{Version: "2.0", Channel: channel})
+}
+
+// feedItems converts the directory's recent changes into feed items. Removed rooms are
+// only included if asked for with ?removed=true, and updates are never included.
+func (h *Handlers) feedItems(r *http.Request) []*item {
+	includeRemoved := r.URL.Query().Get("removed") == "true"
+
+	items := make([]*item, 0)
+	for _, c := range h.Directory.RecentChanges() {
+		if c.Type != directory.RoomAdded && !(c.Type == directory.RoomRemoved && includeRemoved) {
+			continue
+		}
+
+		name := c.Room.Name
+		if name == "" {
+			name = c.Room.CanonicalAlias
+		}
+		if name == "" {
+			name = c.Room.RoomID
+		}
+
+		title := "New room: " + name
+		if c.Type == directory.RoomRemoved {
+			title = "Room removed: " + name
+		}
+
+		description := ""
+		if thumbnail := util.ThumbnailPath(c.Room.AvatarUrl, 96); thumbnail != "" {
+			// Feed readers show the description away from this server, so the link needs to be absolute
+			description += fmt.Sprintf(`<p><img src="%s" alt="" width="96" height="96"></p>`, html.EscapeString(baseUrl(r)+thumbnail))
+		}
+		if c.Room.Topic != "" {
+			description += "<p>" + html.EscapeString(c.Room.Topic) + "</p>"
+		}
+		link := util.MatrixToLink(c.Room)
+		description += fmt.Sprintf(`<p><a href="%s">%s</a></p>`, html.EscapeString(link), html.EscapeString(link))
+
+		items = append(items, &item{
+			// The timestamp is part of the GUID so a room which is removed and re-added
+			// shows up as a new item rather than being deduplicated away.
+			Guid:        h.tagUri(c.Timestamp.UTC().Format("2006-01-02"), fmt.Sprintf("room-%s/%s/%d", c.Type, c.Room.RoomID, c.Timestamp.UnixMilli())),
+			Title:       title,
+			Link:        link,
+			Description: description,
+			Timestamp:   c.Timestamp,
+		})
+	}
+
+	return items
+}
+
+// tagUri builds an RFC 4151 tag URI under the directory space's server name
+func (h *Handlers) tagUri(date string, specific string) string {
+	return fmt.Sprintf("tag:%s,%s:%s", h.serverName(), date, specific)
+}
+
+// serverName falls back to the server of the space's alias, as newer room IDs don't
+// include a server name.
+func (h *Handlers) serverName() string {
+	if server := util.ServerName(h.Directory.SpaceId()); server != "" {
+		return server
+	}
+	if root := h.Directory.Current().Root; root != nil && util.ServerName(root.CanonicalAlias) != "" {
+		return util.ServerName(root.CanonicalAlias)
+	}
+	return "localhost"
+}
+
+func (h *Handlers) lastUpdated(items []*item) time.Time {
+	if len(items) > 0 {
+		return items[0].Timestamp
+	}
+	return h.Directory.Current().UpdatedAt
+}
+
+func selfUrl(r *http.Request) string {
+	return baseUrl(r) + r.URL.Path
+}
+
+func baseUrl(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+func writeXml(contentType string, v interface{}) *common.RawResponse {
+	return &common.RawResponse{
+		ContentType: contentType,
+		Write: func(w io.Writer) error {
+			_, err := io.WriteString(w, xml.Header)
+			if err != nil {
+				return err
+			}
+			return xml.NewEncoder(w).Encode(v)
+		},
+	}
+}
@@ -0,0 +1,531 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api"
+	"github.com/t2bot/matrix-room-directory-server/api/admin"
+	"github.com/t2bot/matrix-room-directory-server/api/health"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/key_server"
+	"github.com/t2bot/matrix-room-directory-server/matrix"
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+const (
+	testServerName  = "fake.test"
+	testSpaceAlias  = "#directory:" + testServerName
+	testSpaceId     = "!space:" + testServerName
+	testAccessToken = "syt_test"
+	testAdminToken  = "admin_test"
+	trustedOrigin   = "trusted.example"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeFailure is an error response the fake homeserver sends instead of a hierarchy page.
+type fakeFailure struct {
+	status       int
+	errCode      string
+	retryAfterMs int64
+}
+
+// fakeHomeserver serves just enough of the client-server API for the directory: versions,
+// whoami, alias resolution, a paginated space hierarchy, room tombstones and thumbnails.
+type fakeHomeserver struct {
+	*httptest.Server
+
+	lock              sync.Mutex
+	accessToken       string
+	aliases           map[string]string
+	rooms             []*models.PublicRoomEntry
+	pageSize          int
+	failures          []fakeFailure
+	hierarchyRequests int
+
+	// upgrades are the rooms outside the space which replace upgraded rooms
+	upgrades      map[string]*models.PublicRoomEntry
+	tombstones    map[string]string
+	stateRequests int
+
+	// media maps "server/mediaId" to the thumbnail served for it
+	media map[string][]byte
+}
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	hs := &fakeHomeserver{
+		accessToken: testAccessToken,
+		aliases:     map[string]string{testSpaceAlias: testSpaceId},
+		rooms:       make([]*models.PublicRoomEntry, 0),
+		pageSize:    50,
+		upgrades:    make(map[string]*models.PublicRoomEntry),
+		tombstones:  make(map[string]string),
+		media:       make(map[string][]byte),
+	}
+
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/_matrix/client/versions", hs.versions).Methods("GET")
+	rtr.HandleFunc("/_matrix/client/v3/account/whoami", hs.authed(hs.whoami)).Methods("GET")
+	rtr.HandleFunc("/_matrix/client/v3/directory/room/{alias}", hs.authed(hs.resolveAlias)).Methods("GET")
+	rtr.HandleFunc("/_matrix/client/v1/rooms/{roomId}/hierarchy", hs.authed(hs.hierarchy)).Methods("GET")
+	rtr.HandleFunc("/_matrix/client/v3/rooms/{roomId}/state/{eventType}/{stateKey:.*}", hs.authed(hs.stateEvent)).Methods("GET")
+	rtr.HandleFunc("/_matrix/client/v1/media/thumbnail/{server}/{mediaId}", hs.authed(hs.thumbnail)).Methods("GET")
+	rtr.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMatrixError(w, http.StatusNotFound, matrix.ErrCodeNotFound, 0)
+	})
+
+	hs.Server = httptest.NewServer(rtr)
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+// addRoom adds a public room to the space, returning it so tests can change it.
+func (hs *fakeHomeserver) addRoom(localpart string, name string, members int) *models.PublicRoomEntry {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	room := &models.PublicRoomEntry{
+		RoomID:         fmt.Sprintf("!%s:%s", localpart, testServerName),
+		CanonicalAlias: fmt.Sprintf("#%s:%s", localpart, testServerName),
+		Name:           name,
+		JoinedCount:    members,
+		JoinRule:       "public",
+		ChildrenState:  make([]*models.ChildrenState, 0),
+	}
+	hs.rooms = append(hs.rooms, room)
+	hs.aliases[room.CanonicalAlias] = room.RoomID
+	return room
+}
+
+// upgradeRoom tombstones the room, pointing at a new public room outside the space which
+// is returned so tests can change it.
+func (hs *fakeHomeserver) upgradeRoom(roomId string, newLocalpart string) *models.PublicRoomEntry {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+
+	room := &models.PublicRoomEntry{
+		RoomID:        fmt.Sprintf("!%s:%s", newLocalpart, testServerName),
+		Name:          newLocalpart,
+		JoinRule:      "public",
+		ChildrenState: make([]*models.ChildrenState, 0),
+	}
+	hs.upgrades[room.RoomID] = room
+	hs.tombstones[roomId] = room.RoomID
+	return room
+}
+
+// failNext makes the next hierarchy requests fail, one per failure.
+// addMedia uploads a thumbnail, returning its mxc:// URI.
+func (hs *fakeHomeserver) addMedia(mediaId string, thumbnail []byte) string {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.media[testServerName+"/"+mediaId] = thumbnail
+	return fmt.Sprintf("mxc://%s/%s", testServerName, mediaId)
+}
+
+func (hs *fakeHomeserver) failNext(failures ...fakeFailure) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.failures = append(hs.failures, failures...)
+}
+
+func (hs *fakeHomeserver) setAccessToken(token string) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.accessToken = token
+}
+
+func (hs *fakeHomeserver) hierarchyRequestCount() int {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return hs.hierarchyRequests
+}
+
+func (hs *fakeHomeserver) stateRequestCount() int {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	return hs.stateRequests
+}
+
+func (hs *fakeHomeserver) authed(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hs.lock.Lock()
+		token := hs.accessToken
+		hs.lock.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			writeMatrixError(w, http.StatusUnauthorized, matrix.ErrCodeUnknownToken, 0)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (hs *fakeHomeserver) versions(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{"versions": []string{"v1.1", "v1.2", "v1.11"}})
+}
+
+func (hs *fakeHomeserver) whoami(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]interface{}{"user_id": "@directory:" + testServerName})
+}
+
+func (hs *fakeHomeserver) resolveAlias(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	roomId, ok := hs.aliases[mux.Vars(r)["alias"]]
+	hs.lock.Unlock()
+
+	if !ok {
+		writeMatrixError(w, http.StatusNotFound, matrix.ErrCodeNotFound, 0)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"room_id": roomId, "servers": []string{testServerName}})
+}
+
+func (hs *fakeHomeserver) hierarchy(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.hierarchyRequests++
+
+	if len(hs.failures) > 0 {
+		f := hs.failures[0]
+		hs.failures = hs.failures[1:]
+		writeMatrixError(w, f.status, f.errCode, f.retryAfterMs)
+		return
+	}
+	if upgrade, ok := hs.upgrades[mux.Vars(r)["roomId"]]; ok {
+		writeJson(w, http.StatusOK, map[string]interface{}{"rooms": []*models.PublicRoomEntry{upgrade}})
+		return
+	}
+	if mux.Vars(r)["roomId"] != testSpaceId {
+		writeMatrixError(w, http.StatusForbidden, matrix.ErrCodeForbidden, 0)
+		return
+	}
+
+	// The space comes first, with a child event for every room
+	space := &models.PublicRoomEntry{
+		RoomID:        testSpaceId,
+		Name:          "Directory",
+		RoomType:      "m.space",
+		JoinRule:      "public",
+		ChildrenState: make([]*models.ChildrenState, 0),
+	}
+	for _, room := range hs.rooms {
+		space.ChildrenState = append(space.ChildrenState, &models.ChildrenState{
+			Type:     "m.space.child",
+			StateKey: room.RoomID,
+			Content:  map[string]interface{}{"via": []string{testServerName}},
+		})
+	}
+	all := append([]*models.PublicRoomEntry{space}, hs.rooms...)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	pageSize := hs.pageSize
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit < pageSize {
+		pageSize = limit
+	}
+	end := start + pageSize
+	res := map[string]interface{}{}
+	if end < len(all) {
+		res["next_batch"] = strconv.Itoa(end)
+	} else {
+		end = len(all)
+	}
+	res["rooms"] = all[start:end]
+	writeJson(w, http.StatusOK, res)
+}
+
+func (hs *fakeHomeserver) stateEvent(w http.ResponseWriter, r *http.Request) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	hs.stateRequests++
+
+	vars := mux.Vars(r)
+	replacement, ok := hs.tombstones[vars["roomId"]]
+	if vars["eventType"] != "m.room.tombstone" || vars["stateKey"] != "" || !ok {
+		writeMatrixError(w, http.StatusNotFound, matrix.ErrCodeNotFound, 0)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"body": "This room has been replaced", "replacement_room": replacement})
+}
+
+func (hs *fakeHomeserver) thumbnail(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hs.lock.Lock()
+	b, ok := hs.media[vars["server"]+"/"+vars["mediaId"]]
+	hs.lock.Unlock()
+
+	if !ok {
+		writeMatrixError(w, http.StatusNotFound, matrix.ErrCodeNotFound, 0)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(b)
+}
+
+// fakeKeyServer accepts requests signed by trusted origins, recording every check.
+type fakeKeyServer struct {
+	*httptest.Server
+
+	lock   sync.Mutex
+	checks []*http.Request
+}
+
+func newFakeKeyServer(t *testing.T) *fakeKeyServer {
+	ks := &fakeKeyServer{checks: make([]*http.Request, 0)}
+
+	rtr := mux.NewRouter()
+	rtr.HandleFunc("/_matrix/key/unstable/check_auth", ks.checkAuth).Methods("POST")
+	rtr.HandleFunc("/_matrix/key/v2/server", func(w http.ResponseWriter, r *http.Request) {
+		writeJson(w, http.StatusOK, map[string]interface{}{"server_name": "keys.test"})
+	}).Methods("GET")
+
+	ks.Server = httptest.NewServer(rtr)
+	t.Cleanup(ks.Close)
+	return ks
+}
+
+func (ks *fakeKeyServer) checkAuth(w http.ResponseWriter, r *http.Request) {
+	ks.lock.Lock()
+	ks.checks = append(ks.checks, r)
+	ks.lock.Unlock()
+
+	if r.Header.Get("Authorization") != xMatrixAuth(trustedOrigin) {
+		writeMatrixError(w, http.StatusUnauthorized, "M_UNAUTHORIZED", 0)
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{})
+}
+
+func (ks *fakeKeyServer) lastCheck() *http.Request {
+	ks.lock.Lock()
+	defer ks.lock.Unlock()
+	if len(ks.checks) == 0 {
+		return nil
+	}
+	return ks.checks[len(ks.checks)-1]
+}
+
+// fakeChangeStore keeps changes in memory, standing in for the database.
+type fakeChangeStore struct {
+	lock    sync.Mutex
+	changes []*directory.Change
+}
+
+func (cs *fakeChangeStore) LoadChanges(limit int) ([]*directory.Change, error) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if len(cs.changes) > limit {
+		return append([]*directory.Change{}, cs.changes[len(cs.changes)-limit:]...), nil
+	}
+	return append([]*directory.Change{}, cs.changes...), nil
+}
+
+func (cs *fakeChangeStore) SaveChanges(changes []*directory.Change, keep int) error {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.changes = append(cs.changes, changes...)
+	if len(cs.changes) > keep {
+		cs.changes = cs.changes[len(cs.changes)-keep:]
+	}
+	return nil
+}
+
+// xMatrixAuth is the Authorization header the fake key server accepts from origin, if
+// the origin is trusted.
+func xMatrixAuth(origin string) string {
+	return fmt.Sprintf(`X-Matrix origin=%s,key="ed25519:test",sig="signature"`, origin)
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeMatrixError(w http.ResponseWriter, status int, errCode string, retryAfterMs int64) {
+	body := map[string]interface{}{"errcode": errCode, "error": http.StatusText(status)}
+	if retryAfterMs > 0 {
+		body["retry_after_ms"] = retryAfterMs
+	}
+	writeJson(w, status, body)
+}
+
+// harness runs the API's router against a fake homeserver and key server.
+type harness struct {
+	t      *testing.T
+	hs     *fakeHomeserver
+	keys   *fakeKeyServer
+	client *matrix.Client
+	dir    *directory.Service
+	router http.Handler
+	admin  http.Handler
+}
+
+// newHarness sets up the fakes and the directory. setup is called before the directory
+// is first loaded, to add rooms and change the config.
+func newHarness(t *testing.T, setup func(hs *fakeHomeserver, c *config.Config)) *harness {
+	h := &harness{
+		t:    t,
+		hs:   newFakeHomeserver(t),
+		keys: newFakeKeyServer(t),
+	}
+
+	c := config.Default()
+	c.Homeserver.Url = h.hs.URL
+	c.Homeserver.AccessToken = testAccessToken
+	c.Homeserver.Timeout = 5 * time.Second
+	c.Homeserver.MaxRetries = 1
+	c.KeyServer = h.keys.URL
+	c.Space = testSpaceAlias
+	if setup != nil {
+		setup(h.hs, c)
+	}
+
+	h.client = matrix.NewClient(c.Homeserver.Url, c.Homeserver.AccessToken, matrix.Options{
+		Timeout:    c.Homeserver.Timeout,
+		MaxRetries: c.Homeserver.MaxRetries,
+	})
+	spaceId, err := h.client.ResolveRoom(context.Background(), c.Space)
+	if err != nil {
+		t.Fatal("resolving space: ", err)
+	}
+	h.dir = directory.NewService(h.client, spaceId)
+	h.refresh()
+
+	keyServer := key_server.NewKeyServer(c.KeyServer)
+	services := &api.Services{
+		Config: func() *config.Config {
+			return c
+		},
+		Directory: h.dir,
+		Auth:      keyServer,
+		// Results aren't cached, so that tests see changes to the fakes straight away
+		Readiness: &health.Handlers{
+			Checks: map[string]health.Check{
+				"homeserver": func(ctx context.Context) error {
+					_, err := h.client.Whoami(ctx)
+					return err
+				},
+				"key_server": keyServer.Ping,
+				"snapshot":   health.SnapshotCheck(h.dir, c.Health.MaxSnapshotAge),
+			},
+		},
+		Admin: &admin.Handlers{Token: testAdminToken, Directory: h.dir},
+	}
+	h.router = api.NewRouter(services)
+	h.admin = api.NewAdminRouter(services)
+	return h
+}
+
+// refresh updates the directory from the fake homeserver, failing the test if it can't.
+func (h *harness) refresh() {
+	h.t.Helper()
+	if err := h.dir.DoUpdate(); err != nil {
+		h.t.Fatal("updating directory: ", err)
+	}
+}
+
+// do sends a request through the router. If origin is set, the request is signed as if
+// from that server.
+func (h *harness) do(method string, path string, body interface{}, origin string, headers map[string]string) *httptest.ResponseRecorder {
+	h.t.Helper()
+
+	var b []byte
+	if s, ok := body.(string); ok {
+		b = []byte(s)
+	} else if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			h.t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(b))
+	req.Host = "directory.test"
+	if origin != "" {
+		req.Header.Set("Authorization", xMatrixAuth(origin))
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	h.router.ServeHTTP(w, req)
+	return w
+}
+
+// publicRoomsResponse is the body of /publicRooms, with the batch tokens kept as they
+// were sent.
+type publicRoomsResponse struct {
+	Chunk     []*models.PublicRoomEntry `json:"chunk"`
+	NextBatch string                    `json:"next_batch"`
+	PrevBatch string                    `json:"prev_batch"`
+	Total     int                       `json:"total_room_count_estimate"`
+}
+
+// publicRooms makes a successful /publicRooms request as the trusted origin.
+func (h *harness) publicRooms(query string, body interface{}) *publicRoomsResponse {
+	h.t.Helper()
+
+	method := "GET"
+	if body != nil {
+		method = "POST"
+	}
+	w := h.do(method, "/_matrix/federation/v1/publicRooms"+query, body, trustedOrigin, nil)
+	if w.Code != http.StatusOK {
+		h.t.Fatalf("publicRooms%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+	}
+
+	res := &publicRoomsResponse{}
+	decodeJson(h.t, w, res)
+	return res
+}
+
+func decodeJson(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+}
+
+func roomIds(rooms []*models.PublicRoomEntry) string {
+	ids := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		ids = append(ids, r.RoomID)
+	}
+	return strings.Join(ids, ",")
+}
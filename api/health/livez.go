@@ -22,13 +22,15 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type HealthzResponse struct {
+type LivezResponse struct {
 	OK     bool   `json:"ok"`
 	Status string `json:"status"`
 }
 
-func Healthz(r *http.Request, log *logrus.Entry) interface{} {
-	return &HealthzResponse{
+// Livez reports the process is up. It doesn't check anything else, so orchestrators
+// don't restart the server just because the homeserver is down.
+func Livez(r *http.Request, log *logrus.Entry) interface{} {
+	return &LivezResponse{
 		OK:     true,
 		Status: "Probably not dead",
 	}
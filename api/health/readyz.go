@@ -0,0 +1,139 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+)
+
+const (
+	checkTimeout = 5 * time.Second
+
+	// DefaultCacheFor is how long readiness results are normally reused for
+	DefaultCacheFor = 5 * time.Second
+)
+
+// Check returns an error if a dependency isn't usable.
+type Check func(ctx context.Context) error
+
+type ReadyzResponse struct {
+	OK     bool                    `json:"ok"`
+	Checks map[string]*CheckResult `json:"checks"`
+}
+
+// CheckResult doesn't include why a check failed, as /readyz is public. Failures are
+// logged instead.
+type CheckResult struct {
+	OK        bool  `json:"ok"`
+	LatencyMs int64 `json:"latency_ms"`
+}
+
+// Handlers serves the readiness probe.
+type Handlers struct {
+	Checks map[string]Check
+
+	// CacheFor is how long results are reused for, so that frequent requests to /readyz
+	// don't become frequent requests to the homeserver and key server.
+	CacheFor time.Duration
+
+	lock      sync.Mutex
+	last      *ReadyzResponse
+	lastRunAt time.Time
+}
+
+// Readyz runs every check at once, replying with a 503 if any of them fail.
+func (h *Handlers) Readyz(r *http.Request, log *logrus.Entry) interface{} {
+	res := h.results(log)
+	if !res.OK {
+		return common.JsonResponse(http.StatusServiceUnavailable, res)
+	}
+	return res
+}
+
+// results returns the cached results, running the checks if they are too old. The lock
+// is held while the checks run so that concurrent requests share a single run.
+func (h *Handlers) results(log *logrus.Entry) *ReadyzResponse {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.last != nil && time.Since(h.lastRunAt) < h.CacheFor {
+		return h.last
+	}
+	h.last = h.runChecks(log)
+	h.lastRunAt = time.Now()
+	return h.last
+}
+
+func (h *Handlers) runChecks(log *logrus.Entry) *ReadyzResponse {
+	// The results are shared, so they shouldn't depend on one request being cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	res := &ReadyzResponse{
+		OK:     true,
+		Checks: make(map[string]*CheckResult),
+	}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for name, check := range h.Checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := check(ctx)
+			result := &CheckResult{
+				OK:        err == nil,
+				LatencyMs: time.Since(start).Milliseconds(),
+			}
+			if err != nil {
+				log.WithField("check", name).Warn("Readiness check failed: ", err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			res.Checks[name] = result
+			res.OK = res.OK && result.OK
+		}(name, check)
+	}
+	wg.Wait()
+	return res
+}
+
+// SnapshotCheck fails until the directory has been loaded, or if it hasn't been
+// successfully updated within maxAge.
+func SnapshotCheck(dir *directory.Service, maxAge time.Duration) Check {
+	return func(ctx context.Context) error {
+		updatedAt := dir.Current().UpdatedAt
+		if updatedAt.IsZero() {
+			return errors.New("the directory has not been loaded yet")
+		}
+		if age := time.Since(updatedAt); age > maxAge {
+			return fmt.Errorf("the directory was last updated %s ago", age.Round(time.Second))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestReadyzCachesResults(t *testing.T) {
+	var runs int32
+	h := &Handlers{
+		Checks: map[string]Check{
+			"failing": func(ctx context.Context) error {
+				atomic.AddInt32(&runs, 1)
+				return errors.New("secret internal detail")
+			},
+		},
+		CacheFor: time.Minute,
+	}
+
+	for i := 0; i < 3; i++ {
+		h.Readyz(httptest.NewRequest("GET", "/readyz", nil), logrus.NewEntry(logrus.New()))
+	}
+	if runs != 1 {
+		t.Errorf("expected the checks to run once, ran %d times", runs)
+	}
+
+	h.lastRunAt = time.Now().Add(-time.Minute)
+	h.Readyz(httptest.NewRequest("GET", "/readyz", nil), logrus.NewEntry(logrus.New()))
+	if runs != 2 {
+		t.Errorf("expected the checks to run again once the results expired, ran %d times", runs)
+	}
+}
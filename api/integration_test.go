@@ -0,0 +1,450 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api_test
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/t2bot/matrix-room-directory-server/api/health"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/matrix"
+)
+
+// fiveRooms adds rooms with different sizes, so the directory's order is predictable:
+// !e, !d, !c, !b, !a.
+func fiveRooms(hs *fakeHomeserver, c *config.Config) {
+	hs.addRoom("a", "Alpha", 10)
+	hs.addRoom("b", "Bravo", 20)
+	hs.addRoom("c", "Charlie", 30)
+	hs.addRoom("d", "Delta", 40)
+	hs.addRoom("e", "Echo", 50)
+}
+
+func TestHierarchyIsPaginated(t *testing.T) {
+	h := newHarness(t, func(hs *fakeHomeserver, c *config.Config) {
+		fiveRooms(hs, c)
+		hs.pageSize = 2
+	})
+
+	// The space and 5 rooms, 2 per page
+	if n := h.hs.hierarchyRequestCount(); n != 3 {
+		t.Errorf("expected 3 hierarchy requests, got %d", n)
+	}
+	if n := len(h.dir.Current().Rooms); n != 5 {
+		t.Errorf("expected 5 rooms in the directory, got %d", n)
+	}
+}
+
+func TestTombstonesAreFollowed(t *testing.T) {
+	h := newHarness(t, func(hs *fakeHomeserver, c *config.Config) {
+		fiveRooms(hs, c)
+		// Upgraded twice
+		hs.upgradeRoom("!a:fake.test", "a2")
+		hs.upgradeRoom("!a2:fake.test", "a3").JoinedCount = 5
+	})
+
+	if got := roomIds(h.dir.Current().Rooms); got != "!e:fake.test,!d:fake.test,!c:fake.test,!b:fake.test,!a3:fake.test" {
+		t.Errorf("expected the latest replacement to be listed, got %s", got)
+	}
+	// The five rooms, and both replacements
+	if n := h.hs.stateRequestCount(); n != 7 {
+		t.Errorf("expected 7 tombstone lookups, got %d", n)
+	}
+
+	// Replacements are remembered, while the rooms without a tombstone are checked again
+	h.refresh()
+	if n := h.hs.stateRequestCount() - 7; n != 5 {
+		t.Errorf("expected only the 5 rooms without tombstones to be looked up again, got %d lookups", n)
+	}
+	if got := roomIds(h.dir.Current().Rooms); !strings.HasSuffix(got, "!a3:fake.test") {
+		t.Errorf("expected the replacement to stay listed, got %s", got)
+	}
+}
+
+func TestUpgradeFoundOnRefresh(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	h.hs.upgradeRoom("!c:fake.test", "c2").JoinedCount = 30
+	h.refresh()
+
+	if got := roomIds(h.dir.Current().Rooms); got != "!e:fake.test,!d:fake.test,!c2:fake.test,!b:fake.test,!a:fake.test" {
+		t.Errorf("expected the replacement to be listed after the next refresh, got %s", got)
+	}
+}
+
+func TestChangesSurviveRestart(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+	store := &fakeChangeStore{}
+	if err := h.dir.UseChangeStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	h.hs.addRoom("f", "Room F", 5)
+	h.refresh()
+
+	// A new directory is empty until it loads the store, as it would be after a restart
+	restarted := directory.NewService(h.client, h.dir.SpaceId())
+	if got := len(restarted.RecentChanges()); got != 0 {
+		t.Fatalf("expected no changes before loading the store, got %d", got)
+	}
+	if err := restarted.UseChangeStore(store); err != nil {
+		t.Fatal(err)
+	}
+	changes := restarted.RecentChanges()
+	if len(changes) != 1 || changes[0].Type != directory.RoomAdded || changes[0].Room.RoomID != "!f:fake.test" {
+		t.Errorf("expected the added room to be loaded from the store, got %+v", changes)
+	}
+}
+
+func TestPublicRoomsPagination(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	all := h.publicRooms("", nil)
+	if got := roomIds(all.Chunk); got != "!e:fake.test,!d:fake.test,!c:fake.test,!b:fake.test,!a:fake.test" {
+		t.Fatalf("unexpected rooms without a limit: %s", got)
+	}
+	if all.Total != 5 || all.NextBatch != "" || all.PrevBatch != "" {
+		t.Errorf("unexpected batch info without a limit: %+v", all)
+	}
+
+	// Walk forwards two at a time, which should see every room exactly once
+	pages := []string{"!e:fake.test,!d:fake.test", "!c:fake.test,!b:fake.test", "!a:fake.test"}
+	query := "?limit=2"
+	prevBatches := make([]string, 0)
+	for i, want := range pages {
+		page := h.publicRooms(query, nil)
+		if got := roomIds(page.Chunk); got != want {
+			t.Fatalf("page %d: expected %s, got %s", i, want, got)
+		}
+		if page.Total != 5 {
+			t.Errorf("page %d: expected a total of 5, got %d", i, page.Total)
+		}
+		prevBatches = append(prevBatches, page.PrevBatch)
+		if i == len(pages)-1 {
+			if page.NextBatch != "" {
+				t.Errorf("last page has a next_batch of %q", page.NextBatch)
+			}
+			break
+		}
+		if page.NextBatch == "" {
+			t.Fatalf("page %d has no next_batch", i)
+		}
+		query = "?limit=2&since=" + page.NextBatch
+	}
+
+	// And back again from the last page
+	if prevBatches[0] != "" {
+		t.Errorf("first page has a prev_batch of %q", prevBatches[0])
+	}
+	back := h.publicRooms("?limit=2&since="+prevBatches[2], nil)
+	if got := roomIds(back.Chunk); got != pages[1] {
+		t.Errorf("going back from the last page: expected %s, got %s", pages[1], got)
+	}
+
+	// Without a limit, the previous page is the start of the list
+	rest := h.publicRooms("?since=3", nil)
+	if got := roomIds(rest.Chunk); got != "!b:fake.test,!a:fake.test" || rest.PrevBatch != "0" {
+		t.Errorf("since without a limit: got %s with prev_batch %q", got, rest.PrevBatch)
+	}
+
+	// Paging past the end is empty rather than an error
+	past := h.publicRooms("?limit=2&since=10", nil)
+	if len(past.Chunk) != 0 || past.NextBatch != "" {
+		t.Errorf("paging past the end: unexpected %+v", past)
+	}
+
+	// Negative or malformed tokens are the client's mistake
+	for _, query := range []string{"?since=-1", "?limit=-1", "?limit=-1&since=2", "?since=abc", "?limit=1.5"} {
+		w := h.do("GET", "/_matrix/federation/v1/publicRooms"+query, nil, trustedOrigin, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d: %s", query, w.Code, w.Body.String())
+			continue
+		}
+		res := map[string]interface{}{}
+		decodeJson(t, w, &res)
+		if res["errcode"] != "M_INVALID_PARAM" {
+			t.Errorf("%s: expected M_INVALID_PARAM, got %v", query, res["errcode"])
+		}
+	}
+
+	// POST bodies page the same way
+	posted := h.publicRooms("", map[string]interface{}{"limit": 2, "since": "2"})
+	if got := roomIds(posted.Chunk); got != pages[1] {
+		t.Errorf("POST with since: expected %s, got %s", pages[1], got)
+	}
+}
+
+func TestPublicRoomsSearch(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	res := h.publicRooms("", map[string]interface{}{"filter": map[string]interface{}{"generic_search_term": "charlie"}})
+	if got := roomIds(res.Chunk); got != "!c:fake.test" {
+		t.Errorf("searching for charlie: expected !c:fake.test, got %s", got)
+	}
+
+	// Typos fall back to fuzzy matching
+	res = h.publicRooms("", map[string]interface{}{"filter": map[string]interface{}{"generic_search_term": "charlei"}})
+	if got := roomIds(res.Chunk); got != "!c:fake.test" {
+		t.Errorf("searching for charlei: expected !c:fake.test, got %s", got)
+	}
+}
+
+func TestPublicRoomsAuth(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	w := h.do("GET", "/_matrix/federation/v1/publicRooms?limit=1", nil, trustedOrigin, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("trusted origin: expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	check := h.keys.lastCheck()
+	if check == nil {
+		t.Fatal("key server was not asked to check the request")
+	}
+	if check.Header.Get("X-Keys-Method") != "GET" || check.Header.Get("X-Keys-URI") != "/_matrix/federation/v1/publicRooms?limit=1" || check.Header.Get("X-Keys-Destination") != "directory.test" {
+		t.Errorf("key server was asked to check the wrong request: %v", check.Header)
+	}
+
+	for name, origin := range map[string]string{"untrusted origin": "evil.example", "unsigned": ""} {
+		w = h.do("GET", "/_matrix/federation/v1/publicRooms", nil, origin, nil)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: expected 500, got %d", name, w.Code)
+		}
+		res := map[string]interface{}{}
+		decodeJson(t, w, &res)
+		if res["errcode"] != "M_UNKNOWN" || res["chunk"] != nil {
+			t.Errorf("%s: unexpected response %v", name, res)
+		}
+	}
+}
+
+func TestErrorMapping(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	cases := []struct {
+		name    string
+		method  string
+		path    string
+		body    interface{}
+		status  int
+		errCode string
+	}{
+		{"bad json", "POST", "/_matrix/federation/v1/publicRooms", "{not json", http.StatusBadRequest, "M_BAD_JSON"},
+		{"unknown route", "GET", "/_matrix/federation/v1/nothing", nil, http.StatusNotFound, "M_NOT_FOUND"},
+		{"wrong method", "DELETE", "/_matrix/federation/v1/publicRooms", nil, http.StatusMethodNotAllowed, "M_UNKNOWN"},
+	}
+	for _, c := range cases {
+		w := h.do(c.method, c.path, c.body, trustedOrigin, nil)
+		if w.Code != c.status {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.status, w.Code, w.Body.String())
+			continue
+		}
+		res := map[string]interface{}{}
+		decodeJson(t, w, &res)
+		if res["errcode"] != c.errCode {
+			t.Errorf("%s: expected %s, got %v", c.name, c.errCode, res["errcode"])
+		}
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	first := h.do("GET", "/_matrix/federation/v1/publicRooms", nil, trustedOrigin, nil)
+	etag := first.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("response has no ETag")
+	}
+	if !strings.HasPrefix(first.Header().Get("Cache-Control"), "max-age=") {
+		t.Errorf("unexpected Cache-Control: %q", first.Header().Get("Cache-Control"))
+	}
+
+	// Refreshing without any changes keeps the same ETag
+	h.refresh()
+	w := h.do("GET", "/_matrix/federation/v1/publicRooms", nil, trustedOrigin, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("unchanged directory: expected 304, got %d", w.Code)
+	}
+
+	// A new room shows up on the next refresh, and changes the ETag
+	h.hs.addRoom("f", "Foxtrot", 60)
+	h.refresh()
+	w = h.do("GET", "/_matrix/federation/v1/publicRooms", nil, trustedOrigin, map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("changed directory: expected 200, got %d", w.Code)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Error("ETag did not change with the directory")
+	}
+	res := &publicRoomsResponse{}
+	decodeJson(t, w, res)
+	if res.Total != 6 || res.Chunk[0].RoomID != "!f:fake.test" {
+		t.Errorf("new room not listed first: %s", roomIds(res.Chunk))
+	}
+}
+
+func TestHomeserverRateLimit(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+	before := h.hs.hierarchyRequestCount()
+
+	h.hs.failNext(fakeFailure{status: http.StatusTooManyRequests, errCode: matrix.ErrCodeLimitExceeded, retryAfterMs: 20})
+	h.refresh()
+
+	if n := h.hs.hierarchyRequestCount() - before; n != 2 {
+		t.Errorf("expected the rate limited request to be retried once, got %d requests", n)
+	}
+	if n := len(h.dir.Current().Rooms); n != 5 {
+		t.Errorf("expected 5 rooms after retrying, got %d", n)
+	}
+}
+
+func TestHomeserverErrorKeepsDirectory(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+	before := h.dir.Current()
+
+	// Both the first attempt and the retry fail
+	failure := fakeFailure{status: http.StatusBadGateway, errCode: "M_UNKNOWN"}
+	h.hs.failNext(failure, failure)
+	err := h.dir.DoUpdate()
+
+	var matrixErr *matrix.Error
+	if !errors.As(err, &matrixErr) || matrixErr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected a 502 from the homeserver, got %v", err)
+	}
+	if h.dir.Current() != before {
+		t.Error("failed update replaced the directory")
+	}
+	if res := h.publicRooms("", nil); res.Total != 5 {
+		t.Errorf("expected the previous 5 rooms to still be served, got %d", res.Total)
+	}
+}
+
+func TestAliasResolution(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	roomId, err := h.client.ResolveRoom(context.Background(), "#c:fake.test")
+	if err != nil || roomId != "!c:fake.test" {
+		t.Errorf("expected #c:fake.test to resolve to !c:fake.test, got %q (%v)", roomId, err)
+	}
+
+	_, err = h.client.ResolveRoom(context.Background(), "#missing:fake.test")
+	if !matrix.IsNotFound(err) {
+		t.Errorf("expected a not found error for a missing alias, got %v", err)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	h := newHarness(t, fiveRooms)
+
+	w := h.do("GET", "/readyz", nil, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The homeserver no longer accepting our token makes us unready
+	h.hs.setAccessToken("syt_rotated")
+	w = h.do("GET", "/readyz", nil, "", nil)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d: %s", w.Code, w.Body.String())
+	}
+	res := &health.ReadyzResponse{}
+	decodeJson(t, w, res)
+	if res.OK || res.Checks["homeserver"].OK {
+		t.Errorf("expected the homeserver check to fail: %+v", res.Checks["homeserver"])
+	}
+	// Why a check failed is only logged, as the endpoint is public
+	if strings.Contains(w.Body.String(), matrix.ErrCodeUnknownToken) {
+		t.Errorf("expected the error to be left out of the response: %s", w.Body.String())
+	}
+	if !res.Checks["key_server"].OK || !res.Checks["snapshot"].OK {
+		t.Errorf("expected the other checks to pass: %+v", res.Checks)
+	}
+}
+
+func TestMetricsOnlyOnAdminListener(t *testing.T) {
+	h := newHarness(t, func(hs *fakeHomeserver, c *config.Config) {
+		c.Admin.Enabled = true
+		c.Metrics.Enabled = true
+	})
+
+	if w := h.do("GET", "/metrics", nil, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected metrics to not be served publicly, got %d", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	h.admin.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "go_goroutines") {
+		t.Errorf("expected metrics on the admin listener, got %d", w.Code)
+	}
+}
+
+func TestNdjsonExportIsStreamed(t *testing.T) {
+	h := newHarness(t, func(hs *fakeHomeserver, c *config.Config) {
+		fiveRooms(hs, c)
+		c.Exports.Enabled = true
+	})
+
+	w := h.do("GET", "/export/rooms.ndjson?fields=room_id", nil, "", map[string]string{"Accept-Encoding": "gzip"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected a gzipped export, got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if !w.Flushed {
+		t.Error("expected the export to be flushed as it was written")
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 5 {
+		t.Errorf("expected 5 rows, got %d: %s", lines, b)
+	}
+}
+
+func TestThumbnailsAreProxied(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\nnot really a png")
+	h := newHarness(t, func(hs *fakeHomeserver, c *config.Config) {
+		fiveRooms(hs, c)
+		hs.addRoom("f", "Foxtrot", 60).AvatarUrl = hs.addMedia("avatar", png)
+		hs.addMedia("unlisted", png)
+		c.Feeds.Enabled = true
+	})
+
+	w := h.do("GET", "/thumbnails/fake.test/avatar?size=96", nil, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" || w.Body.String() != string(png) {
+		t.Errorf("expected the avatar to be proxied, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// Media which isn't a room's avatar isn't served, so the proxy can't fetch arbitrary media
+	if w := h.do("GET", "/thumbnails/fake.test/unlisted?size=96", nil, "", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected media which isn't an avatar to be refused, got %d", w.Code)
+	}
+	if w := h.do("GET", "/thumbnails/fake.test/avatar?size=97", nil, "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unusual size to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package media
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/matrix"
+)
+
+// Media never changes once uploaded, so thumbnails can be cached for a long time
+const thumbnailMaxAge = 24 * time.Hour
+
+// thumbnailSizes are the sizes which may be asked for, so that the homeserver can't be
+// made to generate thumbnails of every size
+var thumbnailSizes = map[int]bool{32: true, 96: true, 320: true}
+
+// Handlers serves room avatars from the homeserver's media repo, which browsers and feed
+// readers can't use directly as it needs an access token.
+type Handlers struct {
+	Directory *directory.Service
+}
+
+func (h *Handlers) GetThumbnail(r *http.Request, log *logrus.Entry) interface{} {
+	server := mux.Vars(r)["server"]
+	mediaId := mux.Vars(r)["mediaId"]
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || !thumbnailSizes[size] {
+		return common.BadRequestError("size must be 32, 96 or 320")
+	}
+
+	// Only avatars of rooms in the directory are served, so this can't be used to fetch
+	// any media the homeserver can reach
+	if !h.isAvatar(fmt.Sprintf("mxc://%s/%s", server, mediaId)) {
+		return common.NotFoundError()
+	}
+
+	b, err := h.Directory.Client().GetThumbnail(r.Context(), server, mediaId, size)
+	if matrix.IsNotFound(err) {
+		return common.NotFoundError()
+	}
+	if err != nil {
+		log.Error("Error fetching thumbnail: ", err)
+		return common.InternalServerError("failed to fetch thumbnail")
+	}
+
+	return &common.CachedResponse{
+		ETag:   fmt.Sprintf(`"%s/%s/%d"`, server, mediaId, size),
+		MaxAge: thumbnailMaxAge,
+		Body:   common.NewEncodedBody(http.DetectContentType(b), b),
+	}
+}
+
+// isAvatar checks whether the media is the avatar of a room in the directory, or one
+// recently removed from it which may still be in the feeds.
+func (h *Handlers) isAvatar(mxc string) bool {
+	snapshot := h.Directory.Current()
+	if snapshot.Root != nil && snapshot.Root.AvatarUrl == mxc {
+		return true
+	}
+	for _, r := range snapshot.Rooms {
+		if r.AvatarUrl == mxc {
+			return true
+		}
+	}
+	for _, c := range h.Directory.RecentChanges() {
+		if c.Room.AvatarUrl == mxc {
+			return true
+		}
+	}
+	return false
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ * Copyright 2019 - 2022 Travis Ralston <travis@t2bot.io>
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -20,9 +20,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/metrics"
+	"github.com/t2bot/matrix-room-directory-server/tracing"
+	"github.com/t2bot/matrix-room-directory-server/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type handler struct {
@@ -31,13 +39,40 @@ type handler struct {
 }
 
 func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-ID")
+	if requestId == "" || len(requestId) > 64 {
+		requestId = util.RandomString(8)
+	}
+	w.Header().Set("X-Request-ID", requestId)
+
 	contextLog := logrus.WithFields(logrus.Fields{
-		"method":   r.Method,
-		"host":     r.Host,
-		"resource": r.URL.Path,
+		"method":     r.Method,
+		"host":       r.Host,
+		"resource":   r.URL.Path,
+		"request_id": requestId,
+		"action":     h.action,
 	})
 	contextLog.Info("Received request")
 
+	ctx, span := tracing.StartSpan(tracing.Extract(r.Context(), r.Header), "handler."+h.action, trace.WithSpanKind(trace.SpanKindServer))
+	span.SetAttributes(attribute.String("http.method", r.Method), attribute.String("http.target", r.URL.Path))
+	r = r.WithContext(ctx)
+
+	start := time.Now()
+	statusCode := http.StatusOK
+	defer func() {
+		metrics.HttpRequests.WithLabelValues(h.action, r.Method, strconv.Itoa(statusCode)).Inc()
+		metrics.HttpDuration.WithLabelValues(h.action).Observe(time.Since(start).Seconds())
+
+		span.SetAttributes(attribute.Int("http.status_code", statusCode))
+		if statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+		span.End()
+
+		contextLog.WithField("status", statusCode).Infof("Replied in %s", time.Since(start))
+	}()
+
 	w.Header().Set("Server", "matrix-room-directory-server")
 
 	// Process response
@@ -46,13 +81,63 @@ func (h handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res = &common.EmptyResponse{}
 	}
 
-	contextLog.Info(fmt.Sprintf("Replying with result: %T %+v", res, res))
+	// Responses can be huge (the whole directory), so only log them when debugging
+	if contextLog.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		contextLog.Debug(fmt.Sprintf("Replying with result: %T %+v", res, res))
+	}
 
-	statusCode := http.StatusOK
 	switch result := res.(type) {
 	case *common.ErrorResponse:
 		statusCode = result.HttpStatus
 		break
+	case *common.RateLimitedResponse:
+		statusCode = result.HttpStatus
+		break
+	case *common.CachedResponse:
+		w.Header().Set("ETag", result.ETag)
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(result.MaxAge.Seconds())))
+		w.Header().Add("Vary", "Accept-Encoding")
+		if common.MatchesETag(r.Header.Get("If-None-Match"), result.ETag) {
+			statusCode = http.StatusNotModified
+			w.WriteHeader(statusCode)
+			return
+		}
+
+		encoding := common.NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+		body := result.Body.Bytes(encoding)
+		if encoding != common.EncodingIdentity {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Type", result.Body.ContentType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(statusCode)
+		_, err := w.Write(body)
+		if err != nil {
+			contextLog.Error("Error writing response: ", err)
+		}
+		return
+	case *common.RawResponse:
+		if result.HttpStatus != 0 {
+			statusCode = result.HttpStatus
+		}
+
+		// Raw responses are usually whole pages or exports, so are worth compressing
+		encoding := common.NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding != common.EncodingIdentity {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Type", result.ContentType)
+		w.WriteHeader(statusCode)
+		cw := common.Compress(w, encoding)
+		err := result.Write(cw)
+		if err == nil {
+			err = cw.Close()
+		}
+		if err != nil {
+			contextLog.Error("Error writing response: ", err)
+		}
+		return
 	default:
 		break
 	}
@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package submissions
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/submissions"
+)
+
+// SubmissionRequest is an anonymous submission. There's no way to prove who is
+// submitting over HTTP, so submitters wanting to hear the decision should use the bot.
+type SubmissionRequest struct {
+	Room string `json:"room"`
+	Note string `json:"note"`
+}
+
+// Handlers serves the public submission API.
+type Handlers struct {
+	Config      func() *config.Config
+	Submissions *submissions.Service
+	limiter     *common.RateLimiter
+}
+
+func NewHandlers(cfg func() *config.Config, subs *submissions.Service) *Handlers {
+	limit := cfg().Submissions.RateLimit
+	return &Handlers{
+		Config:      cfg,
+		Submissions: subs,
+		limiter:     common.NewRateLimiter(limit.Burst, limit.Interval),
+	}
+}
+
+func (h *Handlers) PostSubmission(r *http.Request, log *logrus.Entry) interface{} {
+	// Every submission costs calls to the homeserver and a notice in the management room,
+	// so each IP address is limited. The limit is read each time so that it can be reloaded.
+	limit := h.Config().Submissions.RateLimit
+	h.limiter.SetLimit(limit.Burst, limit.Interval)
+
+	ip := common.ClientIp(r)
+	if ok, retryAfter := h.limiter.Allow(ip); !ok {
+		log.WithField("client_ip", ip).Info("Rate limiting submissions")
+		return common.RateLimitedError(retryAfter)
+	}
+
+	req := SubmissionRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		return common.BadJsonError(err.Error())
+	}
+	if req.Room == "" {
+		return common.BadRequestError("room is required")
+	}
+
+	sub, err := h.Submissions.Submit(r.Context(), req.Room, "", req.Note, "")
+	var invalidErr *submissions.InvalidError
+	if errors.As(err, &invalidErr) {
+		return common.BadRequestError(invalidErr.Message)
+	}
+	if err != nil {
+		log.Error("Error submitting room: ", err)
+		return common.InternalServerError("unable to submit room")
+	}
+
+	return sub
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/config"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 1 * time.Minute
+
+// certReloader serves a certificate from disk, loading it again whenever the files
+// change so that renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+// reloadIfChanged loads the certificate if either file has been modified since it was
+// last loaded, returning whether it was.
+func (r *certReloader) reloadIfChanged() (bool, error) {
+	modTimes := [2]time.Time{}
+	for i, path := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	r.lock.RLock()
+	unchanged := r.cert != nil && modTimes == r.modTimes
+	r.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.lock.Lock()
+	r.cert = &cert
+	r.modTimes = modTimes
+	r.lock.Unlock()
+	return true, nil
+}
+
+func (r *certReloader) watch() {
+	log := logrus.WithField("cert_file", r.certFile)
+	for range time.Tick(certCheckInterval) {
+		reloaded, err := r.reloadIfChanged()
+		if err != nil {
+			// Renewals usually replace the files one at a time, so this may fix itself
+			// on the next check. Until then, the previous certificate is served.
+			log.Warn("Unable to reload TLS certificate: ", err)
+		} else if reloaded {
+			log.Info("Reloaded TLS certificate")
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert, nil
+}
+
+// newTlsConfig builds the TLS settings for a listener, loading its certificate.
+func newTlsConfig(c config.TlsConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     config.TlsVersions[c.MinVersion],
+	}, nil
+}
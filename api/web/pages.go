@@ -0,0 +1,177 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package web
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/common"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+const pageSize = 50
+
+type spacePage struct {
+	Space   *models.PublicRoomEntry
+	Spaces  []*models.PublicRoomEntry
+	Rooms   []*models.PublicRoomEntry
+	Parents []*models.PublicRoomEntry
+	IsRoot  bool
+}
+
+type roomPage struct {
+	Room    *models.PublicRoomEntry
+	Parents []*models.PublicRoomEntry
+}
+
+type searchPage struct {
+	Query    string
+	Rooms    []*models.PublicRoomEntry
+	Total    int
+	Page     int
+	PrevPage int
+	NextPage int
+}
+
+func (h *Handlers) Index(r *http.Request, log *logrus.Entry) interface{} {
+	snapshot := h.directory.Current()
+	if snapshot.Root == nil {
+		return h.render(log, http.StatusServiceUnavailable, "error.html", "The directory has not loaded yet")
+	}
+	return h.renderSpace(log, snapshot, snapshot.Root, true)
+}
+
+func (h *Handlers) Space(r *http.Request, log *logrus.Entry) interface{} {
+	snapshot := h.directory.Current()
+	space := snapshot.Room(mux.Vars(r)["roomId"])
+	if space == nil || !isSpace(space) {
+		return h.render(log, http.StatusNotFound, "error.html", "Space not found")
+	}
+	return h.renderSpace(log, snapshot, space, snapshot.Root != nil && space.RoomID == snapshot.Root.RoomID)
+}
+
+func (h *Handlers) Room(r *http.Request, log *logrus.Entry) interface{} {
+	snapshot := h.directory.Current()
+	room := snapshot.Room(mux.Vars(r)["roomId"])
+	if room == nil || isSpace(room) {
+		return h.render(log, http.StatusNotFound, "error.html", "Room not found")
+	}
+	return h.render(log, http.StatusOK, "room.html", &roomPage{
+		Room:    room,
+		Parents: parents(snapshot, room.RoomID),
+	})
+}
+
+func (h *Handlers) Search(r *http.Request, log *logrus.Entry) interface{} {
+	snapshot := h.directory.Current()
+	query := r.URL.Query().Get("q")
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	var rooms []*models.PublicRoomEntry
+	if query != "" {
+		rooms = snapshot.Index.Search(query)
+		if len(rooms) == 0 {
+			searchConfig := h.config().Search
+			rooms = snapshot.Index.FuzzySearch(query, searchConfig.FuzzyMaxEdits, searchConfig.FuzzyMinSimilarity)
+		}
+	}
+
+	start := util.Min(len(rooms), (page-1)*pageSize)
+	end := util.Min(len(rooms), start+pageSize)
+	result := &searchPage{
+		Query: query,
+		Rooms: rooms[start:end],
+		Total: len(rooms),
+		Page:  page,
+	}
+	if start > 0 {
+		result.PrevPage = page - 1
+	}
+	if end < len(rooms) {
+		result.NextPage = page + 1
+	}
+
+	return h.render(log, http.StatusOK, "search.html", result)
+}
+
+func (h *Handlers) renderSpace(log *logrus.Entry, snapshot *directory.Snapshot, space *models.PublicRoomEntry, isRoot bool) interface{} {
+	page := &spacePage{
+		Space:  space,
+		Spaces: make([]*models.PublicRoomEntry, 0),
+		Rooms:  make([]*models.PublicRoomEntry, 0),
+		IsRoot: isRoot,
+	}
+	if !isRoot {
+		page.Parents = parents(snapshot, space.RoomID)
+	}
+	for _, c := range snapshot.Children(space.RoomID) {
+		if isSpace(c) {
+			page.Spaces = append(page.Spaces, c)
+		} else {
+			page.Rooms = append(page.Rooms, c)
+		}
+	}
+	return h.render(log, http.StatusOK, "space.html", page)
+}
+
+// parents returns the spaces in the directory which list the given room
+func parents(snapshot *directory.Snapshot, roomId string) []*models.PublicRoomEntry {
+	result := make([]*models.PublicRoomEntry, 0)
+	candidates := append([]*models.PublicRoomEntry{snapshot.Root}, snapshot.Rooms...)
+	for _, c := range candidates {
+		if c == nil || !isSpace(c) {
+			continue
+		}
+		for _, child := range snapshot.Children(c.RoomID) {
+			if child.RoomID == roomId {
+				result = append(result, c)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// render executes the template into a buffer first, so that a template error can still
+// be reported with a 500 rather than cutting off a page which was sent as a 200.
+func (h *Handlers) render(log *logrus.Entry, status int, name string, data interface{}) interface{} {
+	buf := &bytes.Buffer{}
+	err := h.templates.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		log.WithField("template", name).Error("Error rendering template: ", err)
+		return common.InternalServerError("failed to render the page")
+	}
+
+	return &common.RawResponse{
+		ContentType: "text/html; charset=utf-8",
+		HttpStatus:  status,
+		Write: func(w io.Writer) error {
+			_, err := buf.WriteTo(w)
+			return err
+		},
+	}
+}
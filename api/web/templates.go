@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package web
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+var funcs = template.FuncMap{
+	"thumbnail": util.ThumbnailPath,
+	"joinLink":  util.MatrixToLink,
+	"roomLink":  roomLink,
+	"isSpace":   isSpace,
+	"roomName":  roomName,
+}
+
+// Handlers serves the HTML website for a directory.
+type Handlers struct {
+	config    func() *config.Config
+	directory *directory.Service
+	templates *template.Template
+}
+
+// NewHandlers parses the built-in page templates, then any templates in the given
+// directory. Templates in the directory replace the built-in template of the same name,
+// so a deployment only needs to supply the templates it wants to change.
+func NewHandlers(cfg func() *config.Config, dir *directory.Service, overrideDir string) (*Handlers, error) {
+	t, err := template.New("").Funcs(funcs).ParseFS(defaultTemplates, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+
+	if overrideDir != "" {
+		matches, err := filepath.Glob(filepath.Join(overrideDir, "*.html"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range matches {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			_, err = t.New(filepath.Base(f)).Parse(string(b))
+			if err != nil {
+				return nil, fmt.Errorf("error parsing %s: %v", f, err)
+			}
+		}
+	}
+
+	return &Handlers{config: cfg, directory: dir, templates: t}, nil
+}
+
+func roomLink(room *models.PublicRoomEntry) string {
+	if isSpace(room) {
+		return "/spaces/" + url.PathEscape(room.RoomID)
+	}
+	return "/rooms/" + url.PathEscape(room.RoomID)
+}
+
+func isSpace(room *models.PublicRoomEntry) bool {
+	return room.RoomType == "m.space"
+}
+
+func roomName(room *models.PublicRoomEntry) string {
+	if room.Name != "" {
+		return room.Name
+	}
+	if room.CanonicalAlias != "" {
+		return room.CanonicalAlias
+	}
+	return room.RoomID
+}
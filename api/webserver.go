@@ -21,9 +21,20 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/api/admin"
+	"github.com/t2bot/matrix-room-directory-server/api/appservice"
+	"github.com/t2bot/matrix-room-directory-server/api/exports"
 	"github.com/t2bot/matrix-room-directory-server/api/federation"
+	"github.com/t2bot/matrix-room-directory-server/api/feeds"
 	"github.com/t2bot/matrix-room-directory-server/api/health"
+	"github.com/t2bot/matrix-room-directory-server/api/media"
+	"github.com/t2bot/matrix-room-directory-server/api/submissions"
+	"github.com/t2bot/matrix-room-directory-server/api/web"
+	"github.com/t2bot/matrix-room-directory-server/audit"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/directory"
 )
 
 type route struct {
@@ -31,16 +42,51 @@ type route struct {
 	handler handler
 }
 
-func Run(listenHost string, listenPort int) {
+// Services are the dependencies of the API handlers.
+type Services struct {
+	// Config returns the current config. Handlers call it for each request, so that
+	// they see reloaded values.
+	Config func() *config.Config
+
+	Directory *directory.Service
+	Auth      federation.Authenticator
+
+	// Readiness serves /readyz
+	Readiness *health.Handlers
+
+	// Website is only required when the website is enabled
+	Website *web.Handlers
+
+	// Appservice is only required in appservice mode
+	Appservice *appservice.Handlers
+
+	// Submissions is only required when submissions are enabled
+	Submissions *submissions.Handlers
+
+	// Admin is only required when the admin API is enabled
+	Admin *admin.Handlers
+
+	// Audit is only required when the audit log is enabled
+	Audit *audit.Log
+}
+
+// NewRouter builds the handler for all of the API's routes, backed by the given services.
+func NewRouter(services *Services) http.Handler {
 	rtr := mux.NewRouter()
+	cfg := services.Config()
 
-	healthzHandler := handler{health.Healthz, "healthz"}
-	fedPublicRoomsHandler := handler{federation.GetPublicRooms, "federation_public_rooms"}
+	fedHandlers := &federation.Handlers{Config: services.Config, Auth: services.Auth, Directory: services.Directory, Audit: services.Audit}
+	exportHandlers := &exports.Handlers{Directory: services.Directory}
+	feedHandlers := &feeds.Handlers{Directory: services.Directory}
+	mediaHandlers := &media.Handlers{Directory: services.Directory}
+
+	livezHandler := handler{health.Livez, "livez"}
+	fedPublicRoomsHandler := handler{fedHandlers.GetPublicRooms, "federation_public_rooms"}
 
 	routes := make(map[string][]route)
 	routes["/_matrix/federation/v1/publicRooms"] = []route{
 		route{"GET", fedPublicRoomsHandler},
-		route{"POST", fedPublicRoomsHandler}, // TODO: Handle searching
+		route{"POST", fedPublicRoomsHandler},
 	}
 
 	for routePath, routes2 := range routes {
@@ -53,14 +99,126 @@ func Run(listenHost string, listenPort int) {
 		}
 	}
 
-	rtr.Handle("/healthz", healthzHandler).Methods("OPTIONS", "GET")
+	if cfg.Website.Enabled {
+		logrus.Info("Registering website routes")
+		rtr.Handle("/", handler{services.Website.Index, "web_index"}).Methods("GET")
+		rtr.Handle("/search", handler{services.Website.Search, "web_search"}).Methods("GET")
+		rtr.Handle("/spaces/{roomId}", handler{services.Website.Space, "web_space"}).Methods("GET")
+		rtr.Handle("/rooms/{roomId}", handler{services.Website.Room, "web_room"}).Methods("GET")
+	}
+
+	if cfg.Exports.Enabled {
+		logrus.Info("Registering export routes")
+		rtr.Handle("/export/rooms.{format}", handler{exportHandlers.GetRooms, "export_rooms"}).Methods("GET")
+	}
+
+	if cfg.Feeds.Enabled {
+		logrus.Info("Registering feed routes")
+		rtr.Handle("/feeds/rooms.atom", handler{feedHandlers.GetAtomFeed, "feed_atom"}).Methods("GET")
+		rtr.Handle("/feeds/rooms.rss", handler{feedHandlers.GetRssFeed, "feed_rss"}).Methods("GET")
+	}
+
+	if cfg.Website.Enabled || cfg.Feeds.Enabled {
+		logrus.Info("Registering thumbnail route")
+		rtr.Handle("/thumbnails/{server}/{mediaId}", handler{mediaHandlers.GetThumbnail, "thumbnail"}).Methods("GET")
+	}
+
+	if cfg.Appservice.Enabled {
+		logrus.Info("Registering appservice routes")
+		txnHandler := handler{services.Appservice.PutTransaction, "appservice_transaction"}
+		queryHandler := handler{services.Appservice.NotFound, "appservice_query"}
+		rtr.Handle("/_matrix/app/v1/transactions/{txnId}", txnHandler).Methods("PUT")
+		rtr.Handle("/transactions/{txnId}", txnHandler).Methods("PUT") // for older homeservers
+		rtr.Handle("/_matrix/app/v1/users/{userId}", queryHandler).Methods("GET")
+		rtr.Handle("/_matrix/app/v1/rooms/{roomAlias}", queryHandler).Methods("GET")
+	}
+
+	if cfg.Submissions.Enabled {
+		logrus.Info("Registering submission routes")
+		rtr.Handle("/submissions", handler{services.Submissions.PostSubmission, "submit_room"}).Methods("POST")
+	}
+
+	rtr.Handle("/livez", livezHandler).Methods("OPTIONS", "GET")
+	rtr.Handle("/healthz", livezHandler).Methods("OPTIONS", "GET") // for existing probes
+	rtr.Handle("/readyz", handler{services.Readiness.Readyz, "readyz"}).Methods("OPTIONS", "GET")
 	rtr.NotFoundHandler = handler{NotFoundHandler, "not_found"}
 	rtr.MethodNotAllowedHandler = handler{MethodNotAllowedHandler, "method_not_allowed"}
 
-	address := fmt.Sprintf("%s:%d", listenHost, listenPort)
+	if cfg.Cors.Enabled {
+		logrus.Info("Enabling CORS")
+		return withCors(cfg.Cors, rtr)
+	}
+	return rtr
+}
+
+// NewAdminRouter builds the handler for the admin API and metrics, which are served
+// separately from the public routes.
+func NewAdminRouter(services *Services) http.Handler {
+	rtr := mux.NewRouter()
+
+	rtr.Handle("/admin/v1/space/children/{room}", handler{services.Admin.PutSpaceChild, "admin_put_space_child"}).Methods("PUT")
+	rtr.Handle("/admin/v1/space/children/{room}", handler{services.Admin.DeleteSpaceChild, "admin_delete_space_child"}).Methods("DELETE")
+	rtr.Handle("/admin/v1/space/order", handler{services.Admin.PutSpaceOrder, "admin_put_space_order"}).Methods("PUT")
+	rtr.Handle("/admin/v1/refresh", handler{services.Admin.PostRefresh, "admin_refresh"}).Methods("POST")
+
+	cfg := services.Config()
+
+	if cfg.Audit.Enabled {
+		rtr.Handle("/admin/v1/federation/origins", handler{services.Admin.GetOriginStats, "admin_origin_stats"}).Methods("GET")
+		rtr.Handle("/admin/v1/federation/searches", handler{services.Admin.GetSearchStats, "admin_search_stats"}).Methods("GET")
+	}
+
+	// Metrics are served here rather than publicly, as they include which servers are
+	// making requests. Scrapers don't need the admin token.
+	if cfg.Metrics.Enabled {
+		logrus.Info("Registering metrics route")
+		rtr.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	}
+
+	rtr.NotFoundHandler = handler{NotFoundHandler, "not_found"}
+	rtr.MethodNotAllowedHandler = handler{MethodNotAllowedHandler, "method_not_allowed"}
+
+	return rtr
+}
+
+// Run serves the handler over plain HTTP (on a Unix socket or TCP port), the TLS port, or
+// both, depending on the listener's config. It only returns if a listener fails to start.
+func Run(listen config.ListenConfig, h http.Handler) {
 	httpMux := http.NewServeMux()
-	httpMux.Handle("/", rtr)
+	httpMux.Handle("/", h)
 
-	logrus.WithField("address", address).Info("Started up. Listening at http://" + address)
-	logrus.Fatal(http.ListenAndServe(address, httpMux))
+	errs := make(chan error, 2)
+	if listen.Socket != "" {
+		mode, err := listen.SocketMode()
+		if err != nil {
+			logrus.Fatal("Invalid socket permissions: ", err)
+		}
+		l, err := listenUnix(listen.Socket, mode)
+		if err != nil {
+			logrus.Fatal("Unable to listen on socket: ", err)
+		}
+		go func() {
+			logrus.WithField("socket", listen.Socket).Info("Started up. Listening at unix:" + listen.Socket)
+			errs <- http.Serve(l, httpMux)
+		}()
+	} else if !listen.Tls.Only {
+		address := fmt.Sprintf("%s:%d", listen.Address, listen.Port)
+		go func() {
+			logrus.WithField("address", address).Info("Started up. Listening at http://" + address)
+			errs <- http.ListenAndServe(address, httpMux)
+		}()
+	}
+	if listen.Tls.Enabled() {
+		tlsConfig, err := newTlsConfig(listen.Tls)
+		if err != nil {
+			logrus.Fatal("Unable to load TLS certificate: ", err)
+		}
+		address := fmt.Sprintf("%s:%d", listen.Address, listen.Tls.Port)
+		server := &http.Server{Addr: address, Handler: httpMux, TLSConfig: tlsConfig}
+		go func() {
+			logrus.WithField("address", address).Info("Started up. Listening at https://" + address)
+			errs <- server.ListenAndServeTLS("", "")
+		}()
+	}
+	logrus.Fatal(<-errs)
 }
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+// AutoJoin joins the bot to the public rooms in the directory, both those listed now
+// and any which are added later. Being joined lets the bot read the rooms' full state,
+// such as tombstones, which the hierarchy API doesn't expose. Rooms are joined one at
+// a time by a single worker, however quickly they are added.
+func AutoJoin(dir *directory.Service) {
+	q := &joinQueue{
+		queued: make(map[string]bool),
+		wake:   make(chan bool, 1),
+	}
+
+	dir.OnChanges(func(changes []*directory.Change) {
+		added := make([]*models.PublicRoomEntry, 0)
+		for _, c := range changes {
+			if c.Type == directory.RoomAdded {
+				added = append(added, c.Room)
+			}
+		}
+		q.add(added)
+	})
+	q.add(dir.Current().Rooms)
+
+	go func() {
+		for range q.wake {
+			joinRooms(dir, q.take())
+		}
+	}()
+}
+
+// joinQueue collects rooms to join until the worker is ready for them.
+type joinQueue struct {
+	lock   sync.Mutex
+	rooms  []*models.PublicRoomEntry
+	queued map[string]bool
+	wake   chan bool
+}
+
+func (q *joinQueue) add(rooms []*models.PublicRoomEntry) {
+	if len(rooms) == 0 {
+		return
+	}
+
+	q.lock.Lock()
+	for _, r := range rooms {
+		if !q.queued[r.RoomID] {
+			q.queued[r.RoomID] = true
+			q.rooms = append(q.rooms, r)
+		}
+	}
+	q.lock.Unlock()
+
+	select {
+	case q.wake <- true:
+	default:
+	}
+}
+
+func (q *joinQueue) take() []*models.PublicRoomEntry {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	rooms := q.rooms
+	q.rooms = nil
+	q.queued = make(map[string]bool)
+	return rooms
+}
+
+func joinRooms(dir *directory.Service, rooms []*models.PublicRoomEntry) {
+	ctx := context.Background()
+	client := dir.Client()
+
+	joinedRooms, err := client.JoinedRooms(ctx)
+	if err != nil {
+		logrus.Error("Error listing joined rooms, not auto-joining: ", err)
+		return
+	}
+	joined := make(map[string]bool)
+	for _, roomId := range joinedRooms {
+		joined[roomId] = true
+	}
+
+	via := viaServers(dir.Current())
+	joinedAny := false
+	for _, r := range rooms {
+		if joined[r.RoomID] || r.JoinRule != "public" {
+			continue
+		}
+
+		log := logrus.WithField("room_id", r.RoomID)
+		servers := via[r.RoomID]
+		if len(servers) == 0 {
+			// The room's own server is the best bet if the space didn't say
+			servers = util.ViaServers(r.RoomID)
+		}
+		err = client.JoinRoom(ctx, r.RoomID, servers)
+		if err != nil {
+			log.Warn("Error auto-joining room: ", err)
+			continue
+		}
+		log.Info("Auto-joined room")
+		joinedAny = true
+	}
+
+	// Rooms which were just joined might have state worth reading now
+	if joinedAny {
+		dir.RequestUpdate()
+	}
+}
+
+// viaServers returns the servers each room can be joined through, from the via lists
+// of the m.space.child events pointing at it.
+func viaServers(snapshot *directory.Snapshot) map[string][]string {
+	via := make(map[string][]string)
+	spaces := append([]*models.PublicRoomEntry{snapshot.Root}, snapshot.Rooms...)
+	for _, space := range spaces {
+		if space == nil {
+			continue
+		}
+		for _, c := range space.ChildrenState {
+			servers, _ := c.Content["via"].([]interface{})
+			for _, s := range servers {
+				if server, ok := s.(string); ok {
+					via[c.StateKey] = append(via[c.StateKey], server)
+				}
+			}
+		}
+	}
+	return via
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package appservice
+
+import (
+	"io"
+
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Registration is the appservice registration file given to the homeserver.
+type Registration struct {
+	Id              string     `yaml:"id"`
+	Url             *string    `yaml:"url"`
+	AsToken         string     `yaml:"as_token"`
+	HsToken         string     `yaml:"hs_token"`
+	SenderLocalpart string     `yaml:"sender_localpart"`
+	RateLimited     bool       `yaml:"rate_limited"`
+	Namespaces      Namespaces `yaml:"namespaces"`
+}
+
+// Namespaces are left empty: the appservice only acts as its bot user.
+type Namespaces struct {
+	Users   []interface{} `yaml:"users"`
+	Aliases []interface{} `yaml:"aliases"`
+	Rooms   []interface{} `yaml:"rooms"`
+}
+
+// NewRegistration builds the registration for the given appservice config.
+func NewRegistration(c config.AppserviceConfig) *Registration {
+	r := &Registration{
+		Id:              c.Id,
+		AsToken:         c.AsToken,
+		HsToken:         c.HsToken,
+		SenderLocalpart: c.SenderLocalpart,
+		RateLimited:     false,
+		Namespaces: Namespaces{
+			Users:   make([]interface{}, 0),
+			Aliases: make([]interface{}, 0),
+			Rooms:   make([]interface{}, 0),
+		},
+	}
+	// The homeserver wants an explicit null when there's nowhere to send transactions
+	if c.Url != "" {
+		r.Url = &c.Url
+	}
+	return r
+}
+
+// Write writes the registration as YAML.
+func (r *Registration) Write(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err := encoder.Encode(r)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
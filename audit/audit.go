@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	queueSize     = 1000
+	pruneInterval = 1 * time.Hour
+)
+
+// Entry is an authenticated federation request.
+type Entry struct {
+	Origin     string
+	Method     string
+	Route      string
+	SearchTerm string
+	// Filter is the request's filter as JSON, or empty if it didn't have one
+	Filter      string
+	ResultCount int
+	Latency     time.Duration
+	Timestamp   time.Time
+}
+
+// Log records federation requests in the database, deleting them once they are older
+// than the retention period.
+type Log struct {
+	db        *sql.DB
+	retention time.Duration
+	queue     chan *Entry
+	stopChan  chan bool
+}
+
+func NewLog(db *sql.DB, retention time.Duration) *Log {
+	return &Log{
+		db:        db,
+		retention: retention,
+		queue:     make(chan *Entry, queueSize),
+		stopChan:  make(chan bool),
+	}
+}
+
+// BeginRecording starts writing recorded requests to the database in the background,
+// and pruning old ones.
+func (l *Log) BeginRecording() {
+	ticker := time.NewTicker(pruneInterval)
+
+	go func() {
+		defer close(l.stopChan)
+		l.prune()
+		for {
+			select {
+			case <-l.stopChan:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				l.prune()
+			case e := <-l.queue:
+				l.write(e)
+			}
+		}
+	}()
+}
+
+func (l *Log) Stop() {
+	l.stopChan <- true
+}
+
+// Record queues a request to be written to the log. It never blocks the request: if
+// the database can't keep up, the entry is dropped.
+func (l *Log) Record(e *Entry) {
+	select {
+	case l.queue <- e:
+	default:
+		logrus.WithField("origin", e.Origin).Warn("Audit log queue is full, dropping entry")
+	}
+}
+
+func (l *Log) write(e *Entry) {
+	_, err := l.db.Exec(
+		"INSERT INTO federation_requests (origin, method, route, search_term, filter, result_count, latency_us, request_ts) VALUES ($1, $2, $3, $4, $5, $6, $7, $8);",
+		e.Origin, e.Method, e.Route, e.SearchTerm, e.Filter, e.ResultCount, e.Latency.Microseconds(), e.Timestamp.UnixMilli())
+	if err != nil {
+		logrus.WithField("origin", e.Origin).Error("Error writing audit log entry: ", err)
+	}
+}
+
+func (l *Log) prune() {
+	res, err := l.db.Exec("DELETE FROM federation_requests WHERE request_ts < $1;", time.Now().Add(-l.retention).UnixMilli())
+	if err != nil {
+		logrus.Error("Error pruning audit log: ", err)
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		logrus.Infof("Pruned %d audit log entries", n)
+	}
+}
+
+// OriginStats summarises the requests from one server.
+type OriginStats struct {
+	Origin       string `json:"origin"`
+	Requests     int64  `json:"requests"`
+	Searches     int64  `json:"searches"`
+	AvgLatencyMs int64  `json:"avg_latency_ms"`
+	LastSeenTs   int64  `json:"last_seen_ts"`
+}
+
+// SearchStats summarises how often a search term was used. Terms are compared
+// case-insensitively.
+type SearchStats struct {
+	Term       string  `json:"term"`
+	Searches   int64   `json:"searches"`
+	Origins    int64   `json:"origins"`
+	AvgResults float64 `json:"avg_results"`
+}
+
+// Origins returns the servers which made the most requests since the given time.
+func (l *Log) Origins(ctx context.Context, since time.Time, limit int) ([]*OriginStats, error) {
+	rows, err := l.db.QueryContext(ctx,
+		"SELECT origin, COUNT(*), COUNT(*) FILTER (WHERE search_term <> ''), AVG(latency_us)::BIGINT / 1000, MAX(request_ts) FROM federation_requests WHERE request_ts >= $1 GROUP BY origin ORDER BY COUNT(*) DESC, origin ASC LIMIT $2;",
+		since.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]*OriginStats, 0)
+	for rows.Next() {
+		s := &OriginStats{}
+		err = rows.Scan(&s.Origin, &s.Requests, &s.Searches, &s.AvgLatencyMs, &s.LastSeenTs)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// TopSearches returns the most used search terms since the given time.
+func (l *Log) TopSearches(ctx context.Context, since time.Time, limit int) ([]*SearchStats, error) {
+	rows, err := l.db.QueryContext(ctx,
+		"SELECT LOWER(search_term) AS term, COUNT(*), COUNT(DISTINCT origin), AVG(result_count)::DOUBLE PRECISION FROM federation_requests WHERE request_ts >= $1 AND search_term <> '' GROUP BY term ORDER BY COUNT(*) DESC, term ASC LIMIT $2;",
+		since.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]*SearchStats, 0)
+	for rows.Next() {
+		s := &SearchStats{}
+		err = rows.Scan(&s.Term, &s.Searches, &s.Origins, &s.AvgResults)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
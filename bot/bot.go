@@ -0,0 +1,129 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/matrix"
+	"github.com/t2bot/matrix-room-directory-server/submissions"
+)
+
+const commandPrefix = "!dir"
+
+// Bot runs curators' commands sent to the management room, and takes room submissions
+// from anyone in any room it is in.
+type Bot struct {
+	dir         *directory.Service
+	submissions *submissions.Service
+	roomId      string
+	powerLevel  int
+}
+
+// NewBot creates a bot which takes commands in the given room from users with at least
+// the given power level in the directory's space. Submissions are optional.
+func NewBot(dir *directory.Service, subs *submissions.Service, managementRoomId string, powerLevel int) *Bot {
+	return &Bot{
+		dir:         dir,
+		submissions: subs,
+		roomId:      managementRoomId,
+		powerLevel:  powerLevel,
+	}
+}
+
+// HandleEvent runs the command in the event, if it is one. Commands are run in the
+// background so the homeserver isn't kept waiting.
+func (b *Bot) HandleEvent(ev *matrix.Event) {
+	if ev.Type != "m.room.message" || ev.IsState() {
+		return
+	}
+	if msgType, _ := ev.Content["msgtype"].(string); msgType != "m.text" {
+		return
+	}
+	body, _ := ev.Content["body"].(string)
+	args := strings.Fields(body)
+	if len(args) == 0 || args[0] != commandPrefix {
+		return
+	}
+
+	// Anyone can submit a room, from anywhere
+	if len(args) > 1 && args[1] == "submit" && b.submissions != nil {
+		go b.submit(ev.Sender, ev.RoomId, args[2:])
+		return
+	}
+
+	if ev.RoomId != b.roomId {
+		return
+	}
+	go b.handleCommand(ev.Sender, args[1:])
+}
+
+func (b *Bot) handleCommand(sender string, args []string) {
+	ctx := context.Background()
+	log := logrus.WithFields(logrus.Fields{
+		"sender":  sender,
+		"command": strings.Join(args, " "),
+	})
+	log.Info("Received bot command")
+
+	allowed, err := b.isCurator(ctx, sender)
+	if err != nil {
+		log.Error("Error checking power level: ", err)
+		b.reply(ctx, b.roomId, "Unable to check your power level in the directory space")
+		return
+	}
+	if !allowed {
+		log.Warn("Sender does not have permission to run bot commands")
+		b.reply(ctx, b.roomId, fmt.Sprintf("You need power level %d in the directory space to do that", b.powerLevel))
+		return
+	}
+
+	reply, err := b.runCommand(ctx, sender, args)
+	if err != nil {
+		log.Error("Error running bot command: ", err)
+		reply = "There was an error running that command: " + err.Error()
+	}
+	b.reply(ctx, b.roomId, reply)
+}
+
+// isCurator returns whether the user has enough power in the directory's space to run
+// commands.
+func (b *Bot) isCurator(ctx context.Context, userId string) (bool, error) {
+	levels, err := b.dir.Client().GetStateEvent(ctx, b.dir.SpaceId(), "m.room.power_levels", "")
+	if err != nil {
+		return false, err
+	}
+
+	level, _ := levels["users_default"].(float64)
+	if users, ok := levels["users"].(map[string]interface{}); ok {
+		if userLevel, ok := users[userId].(float64); ok {
+			level = userLevel
+		}
+	}
+	return int(level) >= b.powerLevel, nil
+}
+
+func (b *Bot) reply(ctx context.Context, roomId string, text string) {
+	err := b.dir.Client().SendNotice(ctx, roomId, text)
+	if err != nil {
+		logrus.WithField("room_id", roomId).Error("Error replying to bot command: ", err)
+	}
+}
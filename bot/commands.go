@@ -0,0 +1,208 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+const helpText = `Commands:
+!dir add <room> - add a room to the directory space
+!dir remove <room> - remove a room from the directory space
+!dir hide <room> - leave a room in the space, but don't list it
+!dir show <room> - list a hidden room again
+!dir override name|topic <room> [text] - list a room with a different name or topic, or go back to the room's own without text
+!dir refresh - update the directory now
+!dir status - show the state of the directory
+!dir submissions - list the rooms waiting for review
+!dir approve <id> - add a submitted room to the space
+!dir reject <id> [reason] - decline a submitted room
+
+Anyone can submit a room for review with !dir submit <room> [note], in any room the bot is in.`
+
+func (b *Bot) runCommand(ctx context.Context, sender string, args []string) (string, error) {
+	if len(args) == 0 {
+		return helpText, nil
+	}
+
+	switch args[0] {
+	case "add":
+		return b.withRoom(ctx, args, b.add)
+	case "remove":
+		return b.withRoom(ctx, args, b.remove)
+	case "hide":
+		return b.withRoom(ctx, args, b.hide)
+	case "show":
+		return b.withRoom(ctx, args, b.show)
+	case "override":
+		return b.override(ctx, args[1:])
+	case "refresh":
+		return b.refresh()
+	case "status":
+		return b.status(), nil
+	case "submissions", "approve", "reject":
+		if b.submissions == nil {
+			return "Submissions are not enabled.", nil
+		}
+		if args[0] == "submissions" {
+			return b.listSubmissions(ctx)
+		}
+		return b.decide(ctx, sender, args)
+	default:
+		return helpText, nil
+	}
+}
+
+// withRoom resolves the room argument of a command before running it.
+func (b *Bot) withRoom(ctx context.Context, args []string, fn func(ctx context.Context, roomId string, via []string) (string, error)) (string, error) {
+	if len(args) != 2 {
+		return fmt.Sprintf("Usage: %s %s <room alias or ID>", commandPrefix, args[0]), nil
+	}
+
+	roomId, via, err := b.resolve(ctx, args[1])
+	if err != nil {
+		return "", err
+	}
+	return fn(ctx, roomId, via)
+}
+
+// resolve turns a room alias or ID into a room ID, along with servers which should be
+// able to join it.
+func (b *Bot) resolve(ctx context.Context, room string) (string, []string, error) {
+	if !strings.HasPrefix(room, "#") && !strings.HasPrefix(room, "!") {
+		return "", nil, fmt.Errorf("%s is not a room alias or ID", room)
+	}
+
+	roomId, err := b.dir.Client().ResolveRoom(ctx, room)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return roomId, util.ViaServers(roomId, room), nil
+}
+
+func (b *Bot) add(ctx context.Context, roomId string, via []string) (string, error) {
+	_, err := b.dir.UpdateSpaceChild(ctx, roomId, directory.SpaceChildUpdate{Via: via})
+	if err != nil {
+		return "", err
+	}
+	b.dir.RequestUpdate()
+	return fmt.Sprintf("Added %s to the space. It will be listed once the directory updates, if it is public.", roomId), nil
+}
+
+func (b *Bot) remove(ctx context.Context, roomId string, via []string) (string, error) {
+	err := b.dir.RemoveSpaceChild(ctx, roomId)
+	if err != nil {
+		return "", err
+	}
+	b.dir.RequestUpdate()
+	return fmt.Sprintf("Removed %s from the space.", roomId), nil
+}
+
+func (b *Bot) hide(ctx context.Context, roomId string, via []string) (string, error) {
+	o := b.dir.Override(roomId)
+	o.Hidden = true
+	err := b.setOverride(roomId, o)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s is now hidden from the directory.", roomId), nil
+}
+
+func (b *Bot) show(ctx context.Context, roomId string, via []string) (string, error) {
+	o := b.dir.Override(roomId)
+	o.Hidden = false
+	err := b.setOverride(roomId, o)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s is no longer hidden from the directory.", roomId), nil
+}
+
+func (b *Bot) override(ctx context.Context, args []string) (string, error) {
+	if len(args) < 2 || (args[0] != "name" && args[0] != "topic") {
+		return fmt.Sprintf("Usage: %s override name|topic <room alias or ID> [text]", commandPrefix), nil
+	}
+
+	roomId, _, err := b.resolve(ctx, args[1])
+	if err != nil {
+		return "", err
+	}
+	text := strings.Join(args[2:], " ")
+
+	o := b.dir.Override(roomId)
+	if args[0] == "name" {
+		o.Name = text
+	} else {
+		o.Topic = text
+	}
+	err = b.setOverride(roomId, o)
+	if err != nil {
+		return "", err
+	}
+
+	if text == "" {
+		return fmt.Sprintf("%s is now listed with its own %s.", roomId, args[0]), nil
+	}
+	return fmt.Sprintf("%s is now listed with the %s %q.", roomId, args[0], text), nil
+}
+
+// setOverride saves the override and asks for the directory to be updated, so the
+// change shows up straight away rather than on the next scheduled update.
+func (b *Bot) setOverride(roomId string, o directory.Override) error {
+	err := b.dir.SetOverride(roomId, o)
+	if err != nil {
+		return err
+	}
+	b.dir.RequestUpdate()
+	return nil
+}
+
+func (b *Bot) refresh() (string, error) {
+	err := b.dir.DoUpdate()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Updated the directory: %d rooms are listed.", len(b.dir.Current().Rooms)), nil
+}
+
+func (b *Bot) status() string {
+	snapshot := b.dir.Current()
+	hidden := 0
+	overridden := 0
+	for _, o := range b.dir.Overrides() {
+		if o.Hidden {
+			hidden++
+		}
+		if o.Name != "" || o.Topic != "" {
+			overridden++
+		}
+	}
+
+	updated := "never"
+	if !snapshot.UpdatedAt.IsZero() {
+		updated = fmt.Sprintf("%s ago", time.Since(snapshot.UpdatedAt).Round(time.Second))
+	}
+	return fmt.Sprintf("%d rooms are listed from %s, last updated %s. %d rooms are hidden and %d have a name or topic override.",
+		len(snapshot.Rooms), b.dir.SpaceId(), updated, hidden, overridden)
+}
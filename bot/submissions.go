@@ -0,0 +1,103 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/submissions"
+)
+
+// submit handles `!dir submit <room> [note]`, which anyone can send.
+func (b *Bot) submit(sender string, roomId string, args []string) {
+	ctx := context.Background()
+	if len(args) == 0 {
+		b.reply(ctx, roomId, fmt.Sprintf("Usage: %s submit <room alias or ID> [note for the curators]", commandPrefix))
+		return
+	}
+
+	sub, err := b.submissions.Submit(ctx, args[0], sender, strings.Join(args[1:], " "), roomId)
+	var invalidErr *submissions.InvalidError
+	if errors.As(err, &invalidErr) {
+		b.reply(ctx, roomId, fmt.Sprintf("%s: Unable to submit that room: %s", sender, invalidErr.Message))
+		return
+	}
+	if err != nil {
+		logrus.WithField("sender", sender).Error("Error submitting room: ", err)
+		b.reply(ctx, roomId, fmt.Sprintf("%s: There was an error submitting that room", sender))
+		return
+	}
+
+	b.reply(ctx, roomId, fmt.Sprintf("%s: Thanks! %s has been submitted for review, and you'll be told here once a curator has looked at it.", sender, sub.Room))
+}
+
+func (b *Bot) listSubmissions(ctx context.Context) (string, error) {
+	pending, err := b.submissions.Pending(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(pending) == 0 {
+		return "There are no submissions waiting for review.", nil
+	}
+
+	lines := []string{fmt.Sprintf("%d submissions are waiting for review:", len(pending))}
+	for _, sub := range pending {
+		line := fmt.Sprintf("#%d: %s (%s)", sub.Id, sub.Room, sub.RoomId)
+		if sub.Submitter != "" {
+			line += " from " + sub.Submitter
+		}
+		if sub.Note != "" {
+			line += ": " + sub.Note
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (b *Bot) decide(ctx context.Context, sender string, args []string) (string, error) {
+	if len(args) < 2 {
+		return fmt.Sprintf("Usage: %s approve <submission ID>, or %s reject <submission ID> [reason]", commandPrefix, commandPrefix), nil
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+	if err != nil {
+		return fmt.Sprintf("%s is not a submission ID", args[1]), nil
+	}
+
+	var sub *submissions.Submission
+	if args[0] == "approve" {
+		sub, err = b.submissions.Approve(ctx, id, sender)
+	} else {
+		sub, err = b.submissions.Reject(ctx, id, sender, strings.Join(args[2:], " "))
+	}
+	var invalidErr *submissions.InvalidError
+	if errors.As(err, &invalidErr) {
+		return invalidErr.Message, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if sub.Status == submissions.StatusApproved {
+		return fmt.Sprintf("Approved #%d: %s has been added to the space.", sub.Id, sub.Room), nil
+	}
+	return fmt.Sprintf("Rejected #%d.", sub.Id), nil
+}
@@ -0,0 +1,292 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type HomeserverConfig struct {
+	Url         string        `yaml:"url"`
+	AccessToken string        `yaml:"access_token"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxRetries  int           `yaml:"max_retries"`
+}
+
+type AppserviceConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Id              string `yaml:"id"`
+	Url             string `yaml:"url"`
+	AsToken         string `yaml:"as_token"`
+	HsToken         string `yaml:"hs_token"`
+	SenderLocalpart string `yaml:"sender_localpart"`
+	AutoJoin        bool   `yaml:"auto_join"`
+}
+
+type BotConfig struct {
+	ManagementRoom string `yaml:"management_room"`
+	PowerLevel     int    `yaml:"power_level"`
+}
+
+// ListenConfig is where a listener serves plain HTTP: Socket if it is set, otherwise
+// Address and Port.
+type ListenConfig struct {
+	Address           string    `yaml:"address"`
+	Port              int       `yaml:"port"`
+	Socket            string    `yaml:"socket"`
+	SocketPermissions string    `yaml:"socket_permissions"`
+	Tls               TlsConfig `yaml:"tls"`
+}
+
+// SocketMode parses SocketPermissions as an octal file mode.
+func (c ListenConfig) SocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.SocketPermissions, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("file mode out of range: %o", mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// TlsConfig serves HTTPS on its own port when CertFile is set, alongside the plain HTTP
+// port unless Only is set.
+type TlsConfig struct {
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	Port       int    `yaml:"port"`
+	MinVersion string `yaml:"min_version"`
+	Only       bool   `yaml:"only"`
+}
+
+// Enabled returns true if a certificate is configured.
+func (c TlsConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+type CorsConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	AllowedOrigins []string      `yaml:"allowed_origins"`
+	MaxAge         time.Duration `yaml:"max_age"`
+}
+
+type AdminConfig struct {
+	Enabled bool         `yaml:"enabled"`
+	Token   string       `yaml:"token"`
+	Listen  ListenConfig `yaml:"listen"`
+}
+
+type HealthConfig struct {
+	MaxSnapshotAge time.Duration `yaml:"max_snapshot_age"`
+}
+
+type AuditConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Retention time.Duration `yaml:"retention"`
+}
+
+type SearchConfig struct {
+	FuzzyMaxEdits      int     `yaml:"fuzzy_max_edits"`
+	FuzzyMinSimilarity float64 `yaml:"fuzzy_min_similarity"`
+}
+
+type WebsiteConfig struct {
+	Enabled   bool   `yaml:"enabled"`
+	Templates string `yaml:"templates"`
+}
+
+type SubmissionsConfig struct {
+	Enabled   bool            `yaml:"enabled"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+}
+
+// RateLimitConfig allows each client a burst of requests, then one more every interval.
+type RateLimitConfig struct {
+	Burst    int           `yaml:"burst"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type FeatureConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+type DatabaseConfig struct {
+	Postgres string `yaml:"postgres"`
+}
+
+type WebhooksConfig struct {
+	Urls   []string `yaml:"urls"`
+	Secret string   `yaml:"secret"`
+}
+
+type LoggingConfig struct {
+	Format string `yaml:"format"`
+	Level  string `yaml:"level"`
+}
+
+type TracingConfig struct {
+	Exporter     string `yaml:"exporter"`
+	OtlpEndpoint string `yaml:"otlp_endpoint"`
+}
+
+type Config struct {
+	Homeserver           HomeserverConfig  `yaml:"homeserver"`
+	Appservice           AppserviceConfig  `yaml:"appservice"`
+	Bot                  BotConfig         `yaml:"bot"`
+	Submissions          SubmissionsConfig `yaml:"submissions"`
+	KeyServer            string            `yaml:"key_server"`
+	Space                string            `yaml:"space"`
+	UpdateSpaceOnUpgrade bool              `yaml:"update_space_on_upgrade"`
+	Listen               ListenConfig      `yaml:"listen"`
+	Cors                 CorsConfig        `yaml:"cors"`
+	Admin                AdminConfig       `yaml:"admin"`
+	Health               HealthConfig      `yaml:"health"`
+	Audit                AuditConfig       `yaml:"audit"`
+	Search               SearchConfig      `yaml:"search"`
+	Website              WebsiteConfig     `yaml:"website"`
+	Exports              FeatureConfig     `yaml:"exports"`
+	Feeds                FeatureConfig     `yaml:"feeds"`
+	Metrics              FeatureConfig     `yaml:"metrics"`
+	Database             DatabaseConfig    `yaml:"database"`
+	Webhooks             WebhooksConfig    `yaml:"webhooks"`
+	Logging              LoggingConfig     `yaml:"logging"`
+	Tracing              TracingConfig     `yaml:"tracing"`
+}
+
+// Default returns the configuration used for anything not set in the config file or
+// by flags.
+func Default() *Config {
+	return &Config{
+		Homeserver: HomeserverConfig{
+			Url:        "https://t2bot.io",
+			Timeout:    30 * time.Second,
+			MaxRetries: 3,
+		},
+		Appservice: AppserviceConfig{
+			Id:              "room-directory",
+			SenderLocalpart: "room-directory",
+		},
+		Bot: BotConfig{
+			PowerLevel: 50,
+		},
+		KeyServer: "https://keys.t2host.io",
+		Space:     "#directory:t2bot.io",
+		Listen: ListenConfig{
+			Address:           "0.0.0.0",
+			Port:              8080,
+			SocketPermissions: "0660",
+			Tls: TlsConfig{
+				Port:       8443,
+				MinVersion: "1.2",
+			},
+		},
+		Cors: CorsConfig{
+			AllowedOrigins: []string{"*"},
+			MaxAge:         1 * time.Hour,
+		},
+		Admin: AdminConfig{
+			Listen: ListenConfig{
+				Address:           "127.0.0.1",
+				Port:              8081,
+				SocketPermissions: "0600",
+				Tls: TlsConfig{
+					Port:       8444,
+					MinVersion: "1.2",
+				},
+			},
+		},
+		Submissions: SubmissionsConfig{
+			RateLimit: RateLimitConfig{
+				Burst:    5,
+				Interval: 12 * time.Minute,
+			},
+		},
+		Health: HealthConfig{
+			MaxSnapshotAge: 15 * time.Minute,
+		},
+		Audit: AuditConfig{
+			Retention: 30 * 24 * time.Hour,
+		},
+		Search: SearchConfig{
+			FuzzyMaxEdits:      2,
+			FuzzyMinSimilarity: 0.3,
+		},
+		Webhooks: WebhooksConfig{
+			Urls: make([]string, 0),
+		},
+		Logging: LoggingConfig{
+			Format: "text",
+			Level:  "info",
+		},
+	}
+}
+
+var current atomic.Value
+
+func init() {
+	current.Store(Default())
+}
+
+// Get returns the active configuration. The returned config must not be modified.
+func Get() *Config {
+	return current.Load().(*Config)
+}
+
+// Set replaces the active configuration.
+func Set(c *Config) {
+	current.Store(c)
+}
+
+// Load builds a configuration from the defaults, then the YAML file at path (if not
+// empty), then the overrides function, which is how flags and environment variables are
+// applied. The result is validated before being returned.
+func Load(path string, overrides func(c *Config)) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		err = decoder.Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", path, err)
+		}
+	}
+
+	if overrides != nil {
+		overrides(c)
+	}
+
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"reflect"
+)
+
+// ApplyReload swaps in the parts of the new configuration which can safely change while
+// running: the space, search tuning, webhook targets and log level. Everything else keeps
+// its current value until restart. It returns the previous configuration so callers can
+// react to what changed, and the names of any changed settings that were not applied.
+func ApplyReload(next *Config) (*Config, []string) {
+	previous := Get()
+
+	merged := *previous
+	merged.Space = next.Space
+	merged.UpdateSpaceOnUpgrade = next.UpdateSpaceOnUpgrade
+	merged.Search = next.Search
+	merged.Submissions.RateLimit = next.Submissions.RateLimit
+	merged.Webhooks = next.Webhooks
+	merged.Logging.Level = next.Logging.Level
+
+	// Anything still different between what was loaded and what we're using needs a restart
+	ignored := make([]string, 0)
+	want := reflect.ValueOf(*next)
+	have := reflect.ValueOf(merged)
+	for i := 0; i < want.NumField(); i++ {
+		if !reflect.DeepEqual(want.Field(i).Interface(), have.Field(i).Interface()) {
+			ignored = append(ignored, want.Type().Field(i).Tag.Get("yaml"))
+		}
+	}
+
+	Set(&merged)
+	return previous, ignored
+}
@@ -0,0 +1,261 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ValidationError lists every problem found with a configuration, so they can all be
+// fixed at once.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Validate checks the configuration for mistakes that would otherwise only show up once
+// the server is running.
+func (c *Config) Validate() error {
+	problems := make([]string, 0)
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !isHttpUrl(c.Homeserver.Url) {
+		problem("homeserver.url must be an http(s) URL, got %q", c.Homeserver.Url)
+	}
+	if c.Appservice.Enabled {
+		if c.Appservice.AsToken == "" || c.Appservice.HsToken == "" {
+			problem("appservice.as_token and appservice.hs_token are required in appservice mode - generate them with the generate-registration command")
+		}
+		if c.Appservice.Id == "" || c.Appservice.SenderLocalpart == "" {
+			problem("appservice.id and appservice.sender_localpart must not be empty")
+		}
+		if c.Appservice.Url != "" && !isHttpUrl(c.Appservice.Url) {
+			problem("appservice.url must be an http(s) URL, got %q", c.Appservice.Url)
+		}
+	} else if c.Homeserver.AccessToken == "" {
+		problem("homeserver.access_token is required, unless running in appservice mode")
+	}
+	if c.Bot.ManagementRoom != "" {
+		if !c.Appservice.Enabled || c.Appservice.Url == "" {
+			problem("bot.management_room requires appservice mode with appservice.url set, so the bot can receive commands")
+		}
+		if !strings.HasPrefix(c.Bot.ManagementRoom, "#") && !strings.HasPrefix(c.Bot.ManagementRoom, "!") {
+			problem("bot.management_room must be a room alias or room ID, got %q", c.Bot.ManagementRoom)
+		}
+	}
+	if c.Submissions.Enabled && (c.Database.Postgres == "" || c.Bot.ManagementRoom == "") {
+		problem("submissions require database.postgres to queue them and bot.management_room to review them")
+	}
+	if c.Submissions.RateLimit.Burst < 1 {
+		problem("submissions.rate_limit.burst must be at least 1, got %d", c.Submissions.RateLimit.Burst)
+	}
+	if c.Submissions.RateLimit.Interval <= 0 {
+		problem("submissions.rate_limit.interval must be positive, got %s", c.Submissions.RateLimit.Interval)
+	}
+	if c.Homeserver.Timeout <= 0 {
+		problem("homeserver.timeout must be positive, got %s", c.Homeserver.Timeout)
+	}
+	if c.Homeserver.MaxRetries < 0 {
+		problem("homeserver.max_retries must not be negative")
+	}
+	if !isHttpUrl(c.KeyServer) {
+		problem("key_server must be an http(s) URL, got %q", c.KeyServer)
+	}
+	if !strings.HasPrefix(c.Space, "#") && !strings.HasPrefix(c.Space, "!") {
+		problem("space must be a room alias (#directory:example.org) or room ID, got %q", c.Space)
+	}
+	validateListen("listen", c.Listen, problem)
+	if c.Cors.Enabled {
+		for _, o := range c.Cors.AllowedOrigins {
+			if o != "*" && !isOrigin(o) {
+				problem("cors.allowed_origins must only contain \"*\" or origins like https://example.org, got %q", o)
+			}
+		}
+		if c.Cors.MaxAge < 0 {
+			problem("cors.max_age must not be negative")
+		}
+	}
+	if c.Admin.Enabled {
+		if c.Admin.Token == "" {
+			problem("admin.token is required when the admin API is enabled")
+		}
+		validateListen("admin.listen", c.Admin.Listen, problem)
+		if conflict := listenConflict(c.Admin.Listen, c.Listen); conflict != "" {
+			problem("admin.listen and listen can't both use %s", conflict)
+		}
+	}
+	if c.Metrics.Enabled && !c.Admin.Enabled {
+		problem("metrics requires the admin API to be enabled, as /metrics is served on its listener")
+	}
+	if c.Health.MaxSnapshotAge <= 0 {
+		problem("health.max_snapshot_age must be positive, got %s", c.Health.MaxSnapshotAge)
+	}
+	if c.Audit.Enabled {
+		if c.Database.Postgres == "" {
+			problem("audit requires database.postgres to store the log")
+		}
+		if c.Audit.Retention <= 0 {
+			problem("audit.retention must be positive, got %s", c.Audit.Retention)
+		}
+	}
+	if c.Search.FuzzyMaxEdits < 0 {
+		problem("search.fuzzy_max_edits must not be negative")
+	}
+	if c.Search.FuzzyMinSimilarity < 0 || c.Search.FuzzyMinSimilarity > 1 {
+		problem("search.fuzzy_min_similarity must be between 0 and 1, got %v", c.Search.FuzzyMinSimilarity)
+	}
+	for _, u := range c.Webhooks.Urls {
+		if !isHttpUrl(u) {
+			problem("webhooks.urls must only contain http(s) URLs, got %q", u)
+		}
+	}
+	if len(c.Webhooks.Urls) > 0 && c.Database.Postgres == "" {
+		problem("webhooks require database.postgres to be set, as deliveries are queued there")
+	}
+	if !oneOf(c.Logging.Format, "text", "json", "logfmt") {
+		problem("logging.format must be one of text, json or logfmt, got %q", c.Logging.Format)
+	}
+	if !oneOf(c.Logging.Level, "trace", "debug", "info", "warn", "warning", "error", "fatal", "panic") {
+		problem("logging.level must be one of debug, info, warn or error, got %q", c.Logging.Level)
+	}
+	if !oneOf(c.Tracing.Exporter, "", "otlp", "stdout") {
+		problem("tracing.exporter must be otlp, stdout or empty, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.OtlpEndpoint != "" && !isHttpUrl(c.Tracing.OtlpEndpoint) {
+		problem("tracing.otlp_endpoint must be an http(s) URL, got %q", c.Tracing.OtlpEndpoint)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{problems}
+	}
+	return nil
+}
+
+func isHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// isOrigin returns true if s is a scheme and host, with no path, as sent in the Origin
+// header.
+func isOrigin(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && isHttpUrl(s) && u.Path == "" && u.RawQuery == "" && u.User == nil
+}
+
+func oneOf(s string, options ...string) bool {
+	for _, o := range options {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
+
+// TlsVersions maps the accepted values of tls.min_version to their crypto/tls constants.
+var TlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func validateListen(name string, l ListenConfig, problem func(format string, args ...interface{})) {
+	if l.Socket != "" {
+		if l.Tls.Only {
+			problem("%s.socket and %s.tls.only can't both be set", name, name)
+		}
+		if _, err := l.SocketMode(); err != nil {
+			problem("%s.socket_permissions must be an octal file mode like 0660, got %q", name, l.SocketPermissions)
+		}
+	} else if l.Port < 1 || l.Port > 65535 {
+		problem("%s.port must be between 1 and 65535, got %d", name, l.Port)
+	}
+	if !l.Tls.Enabled() {
+		if l.Tls.KeyFile != "" {
+			problem("%s.tls.key_file is set without %s.tls.cert_file, so TLS would not be enabled", name, name)
+		}
+		if l.Tls.Only {
+			problem("%s.tls.only requires %s.tls.cert_file and %s.tls.key_file", name, name, name)
+		}
+		return
+	}
+	if l.Tls.KeyFile == "" {
+		problem("%s.tls.key_file is required when %s.tls.cert_file is set", name, name)
+	}
+	if l.Tls.Port < 1 || l.Tls.Port > 65535 {
+		problem("%s.tls.port must be between 1 and 65535, got %d", name, l.Tls.Port)
+	} else if l.Tls.Port == l.Port && !l.Tls.Only && l.Socket == "" {
+		problem("%s.tls.port must be different from %s.port, unless %s.tls.only is set", name, name, name)
+	}
+	if _, ok := TlsVersions[l.Tls.MinVersion]; !ok {
+		problem("%s.tls.min_version must be one of 1.0, 1.1, 1.2 or 1.3, got %q", name, l.Tls.MinVersion)
+	}
+}
+
+// binding is a socket or TCP address and port a listener serves on.
+type binding struct {
+	socket  string
+	address string
+	port    int
+}
+
+func listenBindings(l ListenConfig) []binding {
+	bindings := make([]binding, 0, 2)
+	if l.Socket != "" {
+		bindings = append(bindings, binding{socket: l.Socket})
+	} else if !l.Tls.Only {
+		bindings = append(bindings, binding{address: l.Address, port: l.Port})
+	}
+	if l.Tls.Enabled() {
+		bindings = append(bindings, binding{address: l.Address, port: l.Tls.Port})
+	}
+	return bindings
+}
+
+// listenConflict describes the socket or port both listeners would try to use, or
+// returns an empty string if they can run side by side.
+func listenConflict(a ListenConfig, b ListenConfig) string {
+	for _, x := range listenBindings(a) {
+		for _, y := range listenBindings(b) {
+			if x.socket != "" && x.socket == y.socket {
+				return fmt.Sprintf("socket %s", x.socket)
+			}
+			if x.socket == "" && y.socket == "" && x.port == y.port && addressesOverlap(x.address, y.address) {
+				return fmt.Sprintf("port %d", x.port)
+			}
+		}
+	}
+	return ""
+}
+
+// addressesOverlap returns true if listening on both addresses at once would conflict,
+// because they are the same or one of them is every address.
+func addressesOverlap(a string, b string) bool {
+	wildcard := func(address string) bool {
+		return address == "" || address == "0.0.0.0" || address == "::" || address == "[::]"
+	}
+	return a == b || wildcard(a) || wildcard(b)
+}
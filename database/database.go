@@ -0,0 +1,99 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+var db *sql.DB
+
+// Setup connects to Postgres and brings the schema up to date.
+func Setup(connectionString string) error {
+	d, err := sql.Open("postgres", connectionString)
+	if err != nil {
+		return err
+	}
+
+	err = d.Ping()
+	if err != nil {
+		return err
+	}
+
+	err = migrate(d)
+	if err != nil {
+		return err
+	}
+
+	db = d
+	return nil
+}
+
+// Get returns the database connection. It panics if Setup has not been called, as
+// callers should only be reachable when a database is configured.
+func Get() *sql.DB {
+	if db == nil {
+		panic(errors.New("database not set up"))
+	}
+	return db
+}
+
+// IsConfigured returns whether Setup has been called successfully.
+func IsConfigured() bool {
+	return db != nil
+}
+
+func migrate(d *sql.DB) error {
+	_, err := d.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INT NOT NULL);")
+	if err != nil {
+		return err
+	}
+
+	version := 0
+	err = d.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version;").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		logrus.Infof("Running database migration %d", i+1)
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO schema_version (version) VALUES ($1);", i+1)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package database
+
+// migrations are applied in order and must never be edited once released. Add a new
+// migration to change the schema instead.
+var migrations = []string{
+	// 1: Webhook delivery queue and log
+	`
+	CREATE TABLE webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		target_url TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload BYTEA NOT NULL,
+		status TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_ts BIGINT NOT NULL,
+		created_ts BIGINT NOT NULL
+	);
+	CREATE INDEX webhook_deliveries_pending ON webhook_deliveries (next_attempt_ts) WHERE status = 'pending';
+	CREATE TABLE webhook_delivery_log (
+		delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+		attempt INT NOT NULL,
+		status_code INT NOT NULL,
+		error TEXT NOT NULL,
+		duration_ms BIGINT NOT NULL,
+		attempt_ts BIGINT NOT NULL
+	);
+	CREATE INDEX webhook_delivery_log_delivery ON webhook_delivery_log (delivery_id);
+	`,
+
+	// 2: Curator overrides of how rooms are listed
+	`
+	CREATE TABLE room_overrides (
+		room_id TEXT PRIMARY KEY,
+		hidden BOOLEAN NOT NULL DEFAULT FALSE,
+		name TEXT NOT NULL DEFAULT '',
+		topic TEXT NOT NULL DEFAULT ''
+	);
+	`,
+
+	// 3: Rooms proposed for the directory, awaiting review
+	`
+	CREATE TABLE room_submissions (
+		id BIGSERIAL PRIMARY KEY,
+		room_id TEXT NOT NULL,
+		room TEXT NOT NULL,
+		submitter TEXT NOT NULL,
+		notify_room_id TEXT NOT NULL,
+		note TEXT NOT NULL,
+		status TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		decided_by TEXT NOT NULL DEFAULT '',
+		created_ts BIGINT NOT NULL,
+		decided_ts BIGINT NOT NULL DEFAULT 0
+	);
+	CREATE UNIQUE INDEX room_submissions_pending ON room_submissions (room_id) WHERE status = 'pending';
+	`,
+
+	// 4: Audit log of federation requests
+	`
+	CREATE TABLE federation_requests (
+		id BIGSERIAL PRIMARY KEY,
+		origin TEXT NOT NULL,
+		method TEXT NOT NULL,
+		route TEXT NOT NULL,
+		search_term TEXT NOT NULL,
+		filter TEXT NOT NULL,
+		result_count INT NOT NULL,
+		latency_us BIGINT NOT NULL,
+		request_ts BIGINT NOT NULL
+	);
+	CREATE INDEX federation_requests_ts ON federation_requests (request_ts);
+	`,
+
+	// 5: Recent changes to the directory, for the feeds
+	`
+	CREATE TABLE directory_changes (
+		id BIGSERIAL PRIMARY KEY,
+		change_type TEXT NOT NULL,
+		room JSONB NOT NULL,
+		previous JSONB NULL,
+		change_ts BIGINT NOT NULL
+	);
+	`,
+}
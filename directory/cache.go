@@ -17,62 +17,181 @@
 package directory
 
 import (
+	"context"
 	"github.com/sirupsen/logrus"
-	"github.com/t2bot/matrix-room-directory-server/common"
 	"github.com/t2bot/matrix-room-directory-server/matrix"
+	"github.com/t2bot/matrix-room-directory-server/metrics"
 	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/tracing"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var Cached []*models.PublicRoomEntry
+// RefreshInterval is how often the directory is updated from the space, unless an
+// update is requested sooner.
+const RefreshInterval = 5 * time.Minute
 
-var stopChan = make(chan bool)
+// Service maintains a cached directory of the rooms in a space.
+type Service struct {
+	client *matrix.Client
 
-func BeginCaching() {
-	ticker := time.NewTicker(5 * time.Minute)
+	settingsLock         sync.RWMutex
+	spaceId              string
+	updateSpaceOnUpgrade bool
+
+	current  atomic.Value
+	stopChan chan bool
+	wake     chan bool
+
+	updateLock sync.Mutex
+
+	overridesLock sync.RWMutex
+	overrides     map[string]Override
+	overrideStore OverrideStore
+
+	changesLock     sync.RWMutex
+	recentChanges   []*Change
+	changeListeners []func(changes []*Change)
+	changeStore     ChangeStore
+
+	// tombstones maps upgraded rooms to their replacement
+	tombstonesLock sync.Mutex
+	tombstones     map[string]string
+}
+
+// NewService creates a directory of the given space, which must be a room ID rather than
+// an alias. The directory is empty until the first DoUpdate.
+func NewService(client *matrix.Client, spaceId string) *Service {
+	s := &Service{
+		client:          client,
+		spaceId:         spaceId,
+		stopChan:        make(chan bool),
+		wake:            make(chan bool, 1),
+		overrides:       make(map[string]Override),
+		recentChanges:   make([]*Change, 0),
+		changeListeners: make([]func(changes []*Change), 0),
+		tombstones:      make(map[string]string),
+	}
+	s.current.Store(newSnapshot(nil, make([]*models.PublicRoomEntry, 0), nil, time.Time{}))
+	return s
+}
+
+// Client returns the Matrix client the directory is built with.
+func (s *Service) Client() *matrix.Client {
+	return s.client
+}
+
+// Configure changes which space the directory is built from, and whether upgraded rooms
+// are replaced in the space itself. The space must be given as a room ID rather than an
+// alias. The directory is not updated until the next DoUpdate.
+func (s *Service) Configure(spaceId string, updateSpaceOnUpgrade bool) {
+	s.settingsLock.Lock()
+	defer s.settingsLock.Unlock()
+	s.spaceId = spaceId
+	s.updateSpaceOnUpgrade = updateSpaceOnUpgrade
+}
+
+// SpaceId returns the room ID of the space the directory is built from.
+func (s *Service) SpaceId() string {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.spaceId
+}
+
+func (s *Service) shouldUpdateSpaceOnUpgrade() bool {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.updateSpaceOnUpgrade
+}
+
+func (s *Service) BeginCaching() {
+	ticker := time.NewTicker(RefreshInterval)
 
 	go func() {
-		defer close(stopChan)
+		defer close(s.stopChan)
 		for {
 			select {
-			case <-stopChan:
+			case <-s.stopChan:
 				ticker.Stop()
 				return
 			case <-ticker.C:
-				err := DoUpdate()
-				if err != nil {
-					logrus.Error("Error updating cache:", err)
-				}
+			case <-s.wake:
+			}
+			err := s.DoUpdate()
+			if err != nil {
+				logrus.Error("Error updating cache:", err)
 			}
 		}
 	}()
 }
 
-func Stop() {
-	stopChan <- true
+// RequestUpdate asks for the directory to be updated in the background as soon as
+// possible. Requests made while an update is pending are merged into it.
+func (s *Service) RequestUpdate() {
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+func (s *Service) Stop() {
+	s.stopChan <- true
 }
 
-func DoUpdate() error {
+func (s *Service) DoUpdate() (err error) {
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+
 	logrus.Info("Updating cache...")
 
-	r, err := matrix.GetHierarchy(common.SpaceId)
+	ctx, span := tracing.StartSpan(context.Background(), "directory.DoUpdate")
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
+	spaceId := s.SpaceId()
+	fetchStart := time.Now()
+	r, err := s.client.GetHierarchy(ctx, spaceId)
+	metrics.HierarchyFetchDuration.Observe(time.Since(fetchStart).Seconds())
 	if err != nil {
+		metrics.HierarchyFetchFailures.Inc()
 		return err
 	}
 
+	var root *models.PublicRoomEntry
 	r2 := make([]*models.PublicRoomEntry, 0)
 	for _, c := range r {
-		if c.RoomID != common.SpaceId {
+		if c.RoomID != spaceId {
 			r2 = append(r2, c)
+		} else {
+			root = c
 		}
 	}
 
+	r2, replaced := s.resolveTombstones(ctx, r2, r)
+	r2 = s.applyOverrides(r2)
+
 	// Order the rooms by size
 	sort.Slice(r2, func(i int, j int) bool {
 		return r2[i].JoinedCount > r2[j].JoinedCount
 	})
 
-	Cached = r2
+	previous := s.Current()
+	snapshot := newSnapshot(root, r2, replaced, time.Now())
+	s.current.Store(snapshot)
+	metrics.DirectorySize.Set(float64(len(snapshot.Rooms)))
+	metrics.SetSnapshotTime(snapshot.UpdatedAt)
+
+	// There's nothing to compare the first snapshot to
+	if !previous.UpdatedAt.IsZero() {
+		changes := diffRooms(previous.Rooms, snapshot.Rooms, snapshot.UpdatedAt)
+		if len(changes) > 0 {
+			logrus.Infof("Directory changed: %d changes", len(changes))
+			s.recordChanges(changes)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package directory
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+type ChangeType string
+
+const (
+	RoomAdded   ChangeType = "added"
+	RoomRemoved ChangeType = "removed"
+	RoomUpdated ChangeType = "updated"
+)
+
+// maxRecentChanges is how many changes are kept for RecentChanges, in memory and in the
+// change store
+const maxRecentChanges = 500
+
+// Change is a difference between two consecutive snapshots of the directory.
+type Change struct {
+	Type      ChangeType
+	Room      *models.PublicRoomEntry
+	Previous  *models.PublicRoomEntry // only set for RoomUpdated
+	Timestamp time.Time
+}
+
+// ChangeStore persists recent changes so they survive restarts.
+type ChangeStore interface {
+	// LoadChanges returns up to limit of the most recent changes, oldest first.
+	LoadChanges(limit int) ([]*Change, error)
+
+	// SaveChanges stores the changes, and forgets all but the most recent keep changes.
+	SaveChanges(changes []*Change, keep int) error
+}
+
+// UseChangeStore loads the recent changes from the store, and saves any later changes to it.
+func (s *Service) UseChangeStore(store ChangeStore) error {
+	changes, err := store.LoadChanges(maxRecentChanges)
+	if err != nil {
+		return err
+	}
+
+	s.changesLock.Lock()
+	defer s.changesLock.Unlock()
+	s.recentChanges = changes
+	s.changeStore = store
+	return nil
+}
+
+// OnChanges registers a function to be called with the changes found by each update.
+// Listeners are called synchronously from the update, so should not block for long.
+func (s *Service) OnChanges(fn func(changes []*Change)) {
+	s.changesLock.Lock()
+	defer s.changesLock.Unlock()
+	s.changeListeners = append(s.changeListeners, fn)
+}
+
+// RecentChanges returns the most recent changes to the directory, newest first. Without a
+// change store these only go back to startup.
+func (s *Service) RecentChanges() []*Change {
+	s.changesLock.RLock()
+	defer s.changesLock.RUnlock()
+
+	result := make([]*Change, len(s.recentChanges))
+	for i, c := range s.recentChanges {
+		result[len(s.recentChanges)-1-i] = c
+	}
+	return result
+}
+
+func (s *Service) recordChanges(changes []*Change) {
+	s.changesLock.Lock()
+	s.recentChanges = append(s.recentChanges, changes...)
+	if len(s.recentChanges) > maxRecentChanges {
+		s.recentChanges = s.recentChanges[len(s.recentChanges)-maxRecentChanges:]
+	}
+	listeners := s.changeListeners
+	store := s.changeStore
+	s.changesLock.Unlock()
+
+	if store != nil && len(changes) > 0 {
+		err := store.SaveChanges(changes, maxRecentChanges)
+		if err != nil {
+			logrus.Error("Error saving directory changes: ", err)
+		}
+	}
+
+	for _, fn := range listeners {
+		fn(changes)
+	}
+}
+
+// diffRooms works out which rooms were added, removed or had their listing changed. The
+// member count is not considered part of the listing, as it changes constantly.
+func diffRooms(before []*models.PublicRoomEntry, after []*models.PublicRoomEntry, ts time.Time) []*Change {
+	changes := make([]*Change, 0)
+
+	beforeById := make(map[string]*models.PublicRoomEntry)
+	for _, r := range before {
+		beforeById[r.RoomID] = r
+	}
+
+	afterById := make(map[string]bool)
+	for _, r := range after {
+		afterById[r.RoomID] = true
+
+		old, ok := beforeById[r.RoomID]
+		if !ok {
+			changes = append(changes, &Change{Type: RoomAdded, Room: r, Timestamp: ts})
+		} else if listingChanged(old, r) {
+			changes = append(changes, &Change{Type: RoomUpdated, Room: r, Previous: old, Timestamp: ts})
+		}
+	}
+
+	for _, r := range before {
+		if !afterById[r.RoomID] {
+			changes = append(changes, &Change{Type: RoomRemoved, Room: r, Timestamp: ts})
+		}
+	}
+
+	return changes
+}
+
+func listingChanged(a *models.PublicRoomEntry, b *models.PublicRoomEntry) bool {
+	return a.Name != b.Name ||
+		a.Topic != b.Topic ||
+		a.CanonicalAlias != b.CanonicalAlias ||
+		a.AvatarUrl != b.AvatarUrl ||
+		a.JoinRule != b.JoinRule ||
+		a.RoomType != b.RoomType ||
+		a.WorldReadable != b.WorldReadable ||
+		a.GuestsAllowed != b.GuestsAllowed
+}
+
+type sqlChangeStore struct {
+	db *sql.DB
+}
+
+// NewSqlChangeStore stores changes in the directory_changes table of the database.
+func NewSqlChangeStore(db *sql.DB) ChangeStore {
+	return &sqlChangeStore{db}
+}
+
+func (s *sqlChangeStore) LoadChanges(limit int) ([]*Change, error) {
+	rows, err := s.db.Query("SELECT change_type, room, previous, change_ts FROM directory_changes ORDER BY id DESC LIMIT $1;", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]*Change, 0)
+	for rows.Next() {
+		changeType := ""
+		room := make([]byte, 0)
+		previous := make([]byte, 0)
+		ts := int64(0)
+		err = rows.Scan(&changeType, &room, &previous, &ts)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &Change{Type: ChangeType(changeType), Timestamp: time.UnixMilli(ts)}
+		err = json.Unmarshal(room, &c.Room)
+		if err != nil {
+			return nil, err
+		}
+		if len(previous) > 0 {
+			err = json.Unmarshal(previous, &c.Previous)
+			if err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, c)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The query returns the newest first, so that the limit keeps the most recent
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	return changes, nil
+}
+
+func (s *sqlChangeStore) SaveChanges(changes []*Change, keep int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range changes {
+		room, err := json.Marshal(c.Room)
+		if err != nil {
+			return err
+		}
+		// Strings rather than bytes, as lib/pq would send bytes as bytea
+		previous := sql.NullString{}
+		if c.Previous != nil {
+			b, err := json.Marshal(c.Previous)
+			if err != nil {
+				return err
+			}
+			previous = sql.NullString{String: string(b), Valid: true}
+		}
+		_, err = tx.Exec(
+			"INSERT INTO directory_changes (change_type, room, previous, change_ts) VALUES ($1, $2, $3, $4);",
+			string(c.Type), string(room), previous, c.Timestamp.UnixMilli())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM directory_changes WHERE id <= (SELECT id FROM directory_changes ORDER BY id DESC OFFSET $1 LIMIT 1);", keep)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package directory
+
+import (
+	"database/sql"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+// Override changes how a room is listed without changing the room itself. Empty
+// fields are left as the room has them.
+type Override struct {
+	Hidden bool
+	Name   string
+	Topic  string
+}
+
+func (o Override) isEmpty() bool {
+	return o == Override{}
+}
+
+// OverrideStore persists overrides so they survive restarts.
+type OverrideStore interface {
+	LoadOverrides() (map[string]Override, error)
+
+	// SaveOverride stores the override for a room, removing it if the override is empty.
+	SaveOverride(roomId string, o Override) error
+}
+
+// UseOverrideStore loads the overrides from the store, and saves any later changes to it.
+func (s *Service) UseOverrideStore(store OverrideStore) error {
+	overrides, err := store.LoadOverrides()
+	if err != nil {
+		return err
+	}
+
+	s.overridesLock.Lock()
+	defer s.overridesLock.Unlock()
+	s.overrides = overrides
+	s.overrideStore = store
+	return nil
+}
+
+// Overrides returns the override for every room which has one.
+func (s *Service) Overrides() map[string]Override {
+	s.overridesLock.RLock()
+	defer s.overridesLock.RUnlock()
+
+	overrides := make(map[string]Override, len(s.overrides))
+	for roomId, o := range s.overrides {
+		overrides[roomId] = o
+	}
+	return overrides
+}
+
+// Override returns the override for a room, which is empty if it has none.
+func (s *Service) Override(roomId string) Override {
+	s.overridesLock.RLock()
+	defer s.overridesLock.RUnlock()
+	return s.overrides[roomId]
+}
+
+// SetOverride replaces the override for a room. It is applied on the next update.
+func (s *Service) SetOverride(roomId string, o Override) error {
+	s.overridesLock.Lock()
+	defer s.overridesLock.Unlock()
+
+	if s.overrideStore != nil {
+		err := s.overrideStore.SaveOverride(roomId, o)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.isEmpty() {
+		delete(s.overrides, roomId)
+	} else {
+		s.overrides[roomId] = o
+	}
+	return nil
+}
+
+// applyOverrides removes hidden rooms and replaces overridden details. Rooms are copied
+// before being changed, as they may be shared with older snapshots.
+func (s *Service) applyOverrides(rooms []*models.PublicRoomEntry) []*models.PublicRoomEntry {
+	s.overridesLock.RLock()
+	defer s.overridesLock.RUnlock()
+
+	result := make([]*models.PublicRoomEntry, 0, len(rooms))
+	for _, r := range rooms {
+		o, ok := s.overrides[r.RoomID]
+		if !ok {
+			result = append(result, r)
+			continue
+		}
+		if o.Hidden {
+			continue
+		}
+
+		c := *r
+		if o.Name != "" {
+			c.Name = o.Name
+		}
+		if o.Topic != "" {
+			c.Topic = o.Topic
+		}
+		result = append(result, &c)
+	}
+	return result
+}
+
+type sqlOverrideStore struct {
+	db *sql.DB
+}
+
+// NewSqlOverrideStore stores overrides in the room_overrides table of the database.
+func NewSqlOverrideStore(db *sql.DB) OverrideStore {
+	return &sqlOverrideStore{db}
+}
+
+func (s *sqlOverrideStore) LoadOverrides() (map[string]Override, error) {
+	rows, err := s.db.Query("SELECT room_id, hidden, name, topic FROM room_overrides;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	overrides := make(map[string]Override)
+	for rows.Next() {
+		roomId := ""
+		o := Override{}
+		err = rows.Scan(&roomId, &o.Hidden, &o.Name, &o.Topic)
+		if err != nil {
+			return nil, err
+		}
+		overrides[roomId] = o
+	}
+	return overrides, rows.Err()
+}
+
+func (s *sqlOverrideStore) SaveOverride(roomId string, o Override) error {
+	if o.isEmpty() {
+		_, err := s.db.Exec("DELETE FROM room_overrides WHERE room_id = $1;", roomId)
+		return err
+	}
+
+	_, err := s.db.Exec(
+		"INSERT INTO room_overrides (room_id, hidden, name, topic) VALUES ($1, $2, $3, $4) ON CONFLICT (room_id) DO UPDATE SET hidden = $2, name = $3, topic = $4;",
+		roomId, o.Hidden, o.Name, o.Topic)
+	return err
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package directory
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/search"
+)
+
+// Snapshot is the state of the directory as of the last update. Snapshots are never
+// modified once published.
+type Snapshot struct {
+	// Root is the space backing the directory. It is not included in Rooms.
+	Root  *models.PublicRoomEntry
+	Rooms []*models.PublicRoomEntry
+	Index *search.Index
+
+	// UpdatedAt is when the snapshot was taken, and is zero before the first update.
+	UpdatedAt time.Time
+
+	// Version identifies the snapshot's contents. Snapshots listing the same rooms have
+	// the same version, even across restarts, so it can be used to validate caches.
+	Version string
+
+	byId     map[string]*models.PublicRoomEntry
+	replaced map[string]string
+}
+
+// Current returns the most recent snapshot of the directory.
+func (s *Service) Current() *Snapshot {
+	return s.current.Load().(*Snapshot)
+}
+
+func newSnapshot(root *models.PublicRoomEntry, rooms []*models.PublicRoomEntry, replaced map[string]string, ts time.Time) *Snapshot {
+	byId := make(map[string]*models.PublicRoomEntry)
+	for _, r := range rooms {
+		byId[r.RoomID] = r
+	}
+	if root != nil {
+		byId[root.RoomID] = root
+	}
+
+	return &Snapshot{
+		Root:      root,
+		Rooms:     rooms,
+		Index:     search.NewIndex(rooms),
+		UpdatedAt: ts,
+		Version:   snapshotVersion(root, rooms),
+		byId:      byId,
+		replaced:  replaced,
+	}
+}
+
+// snapshotVersion hashes the rooms in a snapshot, as they would be served.
+func snapshotVersion(root *models.PublicRoomEntry, rooms []*models.PublicRoomEntry) string {
+	h := fnv.New64a()
+	encoder := json.NewEncoder(h)
+	// Encoding can only fail for values which can't be represented in JSON, which the
+	// rooms were decoded from in the first place
+	_ = encoder.Encode(root)
+	_ = encoder.Encode(rooms)
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// Room returns the room or space with the given ID, or nil if it is not in the directory.
+func (s *Snapshot) Room(roomId string) *models.PublicRoomEntry {
+	return s.byId[roomId]
+}
+
+// Children returns the rooms and spaces directly within the given space, in the order
+// set by the space. Children which have been upgraded are returned as their replacement.
+func (s *Snapshot) Children(spaceId string) []*models.PublicRoomEntry {
+	space := s.byId[spaceId]
+	if space == nil {
+		return nil
+	}
+
+	children := make([]*models.PublicRoomEntry, 0)
+	orders := make(map[string]string)
+	seen := make(map[string]bool)
+	for _, c := range space.ChildrenState {
+		if _, ok := c.Content["via"]; c.Type != "m.space.child" || !ok {
+			continue
+		}
+
+		roomId := c.StateKey
+		if newRoomId, ok := s.replaced[roomId]; ok {
+			roomId = newRoomId
+		}
+
+		room := s.byId[roomId]
+		if room == nil || seen[roomId] {
+			continue
+		}
+		seen[roomId] = true
+		children = append(children, room)
+
+		if order, ok := c.Content["order"].(string); ok {
+			orders[roomId] = order
+		}
+	}
+
+	// Per the spec, children with an order come first, then the rest by size
+	sort.SliceStable(children, func(i int, j int) bool {
+		oi, iok := orders[children[i].RoomID]
+		oj, jok := orders[children[j].RoomID]
+		if iok != jok {
+			return iok
+		}
+		if iok && oi != oj {
+			return oi < oj
+		}
+		return children[i].JoinedCount > children[j].JoinedCount
+	})
+
+	return children
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package directory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+// ErrNotInSpace is returned when changing a room which isn't in the space.
+var ErrNotInSpace = errors.New("room is not in the space")
+
+// SpaceChildUpdate changes a room's m.space.child event in the space. Nil fields keep
+// their current value.
+type SpaceChildUpdate struct {
+	Via       []string
+	Order     *string
+	Suggested *bool
+}
+
+// UpdateSpaceChild adds a room to the space, or changes how it is listed if it is already
+// there. The new content of the m.space.child event is returned. Changes show up in the
+// directory on the next update.
+func (s *Service) UpdateSpaceChild(ctx context.Context, roomId string, update SpaceChildUpdate) (map[string]interface{}, error) {
+	spaceId := s.SpaceId()
+	existing, err := s.client.GetStateEvent(ctx, spaceId, "m.space.child", roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	content := make(map[string]interface{})
+	for k, v := range existing {
+		content[k] = v
+	}
+	if update.Via != nil {
+		content["via"] = update.Via
+	}
+	if _, ok := content["via"]; !ok {
+		via := util.ViaServers(roomId)
+		if len(via) == 0 {
+			// Without a server in the room ID, the space's server is the best guess
+			via = util.ViaServers(spaceId)
+		}
+		content["via"] = via
+	}
+	if update.Order != nil {
+		if *update.Order == "" {
+			delete(content, "order")
+		} else {
+			content["order"] = *update.Order
+		}
+	}
+	if update.Suggested != nil {
+		content["suggested"] = *update.Suggested
+	}
+
+	err = s.client.SendStateEvent(ctx, spaceId, "m.space.child", roomId, content)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// RemoveSpaceChild removes a room from the space.
+func (s *Service) RemoveSpaceChild(ctx context.Context, roomId string) error {
+	return s.client.SendStateEvent(ctx, s.SpaceId(), "m.space.child", roomId, map[string]interface{}{})
+}
+
+// SetSpaceParent points the room back at the space with an m.space.parent event. This
+// needs permission to send state events in the room itself.
+func (s *Service) SetSpaceParent(ctx context.Context, roomId string) error {
+	spaceId := s.SpaceId()
+	return s.client.SendStateEvent(ctx, roomId, "m.space.parent", spaceId, map[string]interface{}{
+		"via": util.ViaServers(spaceId),
+	})
+}
+
+// RemoveSpaceParent removes the room's m.space.parent event for the space.
+func (s *Service) RemoveSpaceParent(ctx context.Context, roomId string) error {
+	return s.client.SendStateEvent(ctx, roomId, "m.space.parent", s.SpaceId(), map[string]interface{}{})
+}
+
+// ReorderSpaceChildren gives the rooms orders so they are listed in the given sequence,
+// ahead of any rooms without an order. The rooms must already be in the space, and are
+// all checked before any are changed.
+func (s *Service) ReorderSpaceChildren(ctx context.Context, roomIds []string) error {
+	spaceId := s.SpaceId()
+	contents := make([]map[string]interface{}, 0, len(roomIds))
+	for _, roomId := range roomIds {
+		content, err := s.client.GetStateEvent(ctx, spaceId, "m.space.child", roomId)
+		if err != nil {
+			return err
+		}
+		if len(content) == 0 {
+			return fmt.Errorf("%s: %w", roomId, ErrNotInSpace)
+		}
+		contents = append(contents, content)
+	}
+
+	for i, roomId := range roomIds {
+		// Leave gaps so a room can be slotted in between by hand later
+		contents[i]["order"] = fmt.Sprintf("%06d", (i+1)*10)
+		err := s.client.SendStateEvent(ctx, spaceId, "m.space.child", roomId, contents[i])
+		if err != nil {
+			return fmt.Errorf("error ordering %s: %w", roomId, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package directory
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+// maxUpgradeHops limits how many successive upgrades of a room are followed
+const maxUpgradeHops = 10
+
+type spaceChild struct {
+	spaceId string
+	content map[string]interface{}
+}
+
+// resolveTombstones swaps out any upgraded rooms for their replacement, provided the
+// replacement is public. The hierarchy is the full, unfiltered hierarchy of the space
+// and is used to find the m.space.child events pointing at upgraded rooms. The returned
+// map is of old room ID to replacement room ID.
+func (s *Service) resolveTombstones(ctx context.Context, rooms []*models.PublicRoomEntry, hierarchy []*models.PublicRoomEntry) ([]*models.PublicRoomEntry, map[string]string) {
+	parents := make(map[string][]spaceChild)
+	listed := make(map[string]bool)
+	for _, r := range hierarchy {
+		listed[r.RoomID] = true
+		for _, c := range r.ChildrenState {
+			if c.Type != "m.space.child" {
+				continue
+			}
+			parents[c.StateKey] = append(parents[c.StateKey], spaceChild{r.RoomID, c.Content})
+		}
+	}
+
+	replaced := make(map[string]string)
+	result := make([]*models.PublicRoomEntry, 0, len(rooms))
+	for _, r := range rooms {
+		replacement := s.findReplacement(ctx, r.RoomID)
+		if replacement == nil {
+			result = append(result, r)
+			continue
+		}
+
+		log := logrus.WithFields(logrus.Fields{
+			"old_room_id": r.RoomID,
+			"new_room_id": replacement.RoomID,
+		})
+		log.Info("Room has been upgraded, listing replacement instead")
+		replaced[r.RoomID] = replacement.RoomID
+
+		if s.shouldUpdateSpaceOnUpgrade() {
+			for _, p := range parents[r.RoomID] {
+				err := s.replaceSpaceChild(ctx, p, r.RoomID, replacement.RoomID)
+				if err != nil {
+					log.WithField("space_id", p.spaceId).Error("Error updating space for upgraded room: ", err)
+				}
+			}
+		}
+
+		// The replacement might already be in the space (or upgraded twice), so don't list it twice
+		if listed[replacement.RoomID] {
+			continue
+		}
+		listed[replacement.RoomID] = true
+		result = append(result, replacement)
+	}
+
+	return result, replaced
+}
+
+// findReplacement returns the room which replaces the given room, following any further
+// upgrades of the replacement, or nil if the room has not been upgraded or the
+// replacement cannot be listed.
+func (s *Service) findReplacement(ctx context.Context, roomId string) *models.PublicRoomEntry {
+	log := logrus.WithField("room_id", roomId)
+
+	newRoomId := roomId
+	seen := map[string]bool{roomId: true}
+	for hop := 0; hop < maxUpgradeHops; hop++ {
+		next := s.tombstoneReplacement(ctx, newRoomId)
+		if next == "" || seen[next] {
+			break
+		}
+		seen[next] = true
+		newRoomId = next
+	}
+	if newRoomId == roomId {
+		return nil
+	}
+
+	replacement, err := s.client.GetRoomSummary(ctx, newRoomId)
+	if err != nil {
+		log.WithField("new_room_id", newRoomId).Warn("Unable to look up replacement room: ", err)
+		return nil
+	}
+	if replacement.JoinRule != "public" {
+		log.WithField("new_room_id", newRoomId).Warn("Replacement room is not public, leaving upgraded room listed")
+		return nil
+	}
+
+	return replacement
+}
+
+// tombstoneReplacement returns the room ID from the room's tombstone, or an empty string
+// if it doesn't have one. Tombstones can't be undone in practice, so replacements are
+// remembered for good. Rooms without one are checked again on every update, so an
+// upgrade is picked up by the next refresh: within RefreshInterval, or straight away in
+// appservice mode, where the tombstone event requests an update.
+func (s *Service) tombstoneReplacement(ctx context.Context, roomId string) string {
+	s.tombstonesLock.Lock()
+	cached, ok := s.tombstones[roomId]
+	s.tombstonesLock.Unlock()
+	if ok {
+		return cached
+	}
+
+	tombstone, err := s.client.GetStateEvent(ctx, roomId, "m.room.tombstone", "")
+	if err != nil {
+		// Most commonly we're just not joined to the room, so don't make noise about it
+		logrus.WithField("room_id", roomId).Debug("Unable to check room for tombstone: ", err)
+		return ""
+	}
+	replacement, _ := tombstone["replacement_room"].(string)
+	if replacement == "" || replacement == roomId {
+		return ""
+	}
+
+	s.tombstonesLock.Lock()
+	defer s.tombstonesLock.Unlock()
+	s.tombstones[roomId] = replacement
+	return replacement
+}
+
+// replaceSpaceChild points the space at the new room, copying the ordering and suggested
+// flags from the old m.space.child event, then removes the old room from the space.
+func (s *Service) replaceSpaceChild(ctx context.Context, parent spaceChild, oldRoomId string, newRoomId string) error {
+	content := make(map[string]interface{})
+	for k, v := range parent.content {
+		content[k] = v
+	}
+
+	via := make([]interface{}, 0)
+	newServer := util.ServerName(newRoomId)
+	if newServer != "" {
+		via = append(via, newServer)
+	}
+	if oldVia, ok := parent.content["via"].([]interface{}); ok {
+		for _, v := range oldVia {
+			if v != newServer {
+				via = append(via, v)
+			}
+		}
+	}
+	content["via"] = via
+
+	err := s.client.SendStateEvent(ctx, parent.spaceId, "m.space.child", newRoomId, content)
+	if err != nil {
+		return err
+	}
+
+	return s.client.SendStateEvent(ctx, parent.spaceId, "m.space.child", oldRoomId, map[string]interface{}{})
+}
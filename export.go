@@ -0,0 +1,82 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/namsral/flag"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/export"
+)
+
+// runExport handles the `export` subcommand, writing the freshly loaded directory to a
+// file or stdout.
+func runExport(dir *directory.Service, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", export.FormatJson, "Format to export the directory in: json, csv or ndjson")
+	fieldsRaw := flags.String("fields", "", "Comma separated list of fields to export. Defaults to all fields.")
+	outputPath := flags.String("output", "", "File to write the export to. Defaults to stdout.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	// Check everything before touching the output file, so a typo doesn't wipe it
+	if !export.ValidFormat(*format) {
+		return fmt.Errorf("unknown export format: %s", *format)
+	}
+	fields, err := export.ParseFields(*fieldsRaw)
+	if err != nil {
+		return err
+	}
+
+	rooms := dir.Current().Rooms
+	logrus.Infof("Exporting %d rooms as %s", len(rooms), *format)
+	if *outputPath == "" {
+		return export.Write(os.Stdout, *format, rooms, fields)
+	}
+	return writeFileAtomically(*outputPath, func(w io.Writer) error {
+		return export.Write(w, *format, rooms, fields)
+	})
+}
+
+// writeFileAtomically writes to a temporary file next to the path, then renames it into
+// place, so the file is never left half written.
+func writeFileAtomically(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	err = write(f)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+const (
+	FormatJson   = "json"
+	FormatCsv    = "csv"
+	FormatNdjson = "ndjson"
+)
+
+var fieldValues = map[string]func(r *models.PublicRoomEntry) interface{}{
+	"room_id":            func(r *models.PublicRoomEntry) interface{} { return r.RoomID },
+	"name":               func(r *models.PublicRoomEntry) interface{} { return r.Name },
+	"canonical_alias":    func(r *models.PublicRoomEntry) interface{} { return r.CanonicalAlias },
+	"topic":              func(r *models.PublicRoomEntry) interface{} { return r.Topic },
+	"avatar_url":         func(r *models.PublicRoomEntry) interface{} { return r.AvatarUrl },
+	"num_joined_members": func(r *models.PublicRoomEntry) interface{} { return r.JoinedCount },
+	"world_readable":     func(r *models.PublicRoomEntry) interface{} { return r.WorldReadable },
+	"guest_can_join":     func(r *models.PublicRoomEntry) interface{} { return r.GuestsAllowed },
+	"join_rule":          func(r *models.PublicRoomEntry) interface{} { return r.JoinRule },
+	"room_type":          func(r *models.PublicRoomEntry) interface{} { return r.RoomType },
+}
+
+// DefaultFields are exported when no fields are requested
+var DefaultFields = []string{
+	"room_id",
+	"name",
+	"canonical_alias",
+	"topic",
+	"avatar_url",
+	"num_joined_members",
+	"world_readable",
+	"guest_can_join",
+	"join_rule",
+	"room_type",
+}
+
+// ParseFields parses a comma separated list of field names, returning the default fields
+// for an empty list.
+func ParseFields(raw string) ([]string, error) {
+	if strings.TrimSpace(raw) == "" {
+		return DefaultFields, nil
+	}
+
+	fields := make([]string, 0)
+	for _, f := range strings.Split(raw, ",") {
+		f = strings.TrimSpace(f)
+		if _, ok := fieldValues[f]; !ok {
+			return nil, fmt.Errorf("unknown field: %s", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// ValidFormat returns true if the rooms can be exported in the given format
+func ValidFormat(format string) bool {
+	return format == FormatJson || format == FormatCsv || format == FormatNdjson
+}
+
+// ContentType returns the MIME type of the given export format
+func ContentType(format string) string {
+	switch format {
+	case FormatCsv:
+		return "text/csv; charset=utf-8"
+	case FormatNdjson:
+		return "application/x-ndjson"
+	default:
+		return "application/json"
+	}
+}
+
+// Write renders the rooms in the given format. Rooms are always written in room ID order
+// so that two exports of the same directory are byte-for-byte identical.
+func Write(w io.Writer, format string, rooms []*models.PublicRoomEntry, fields []string) error {
+	sorted := make([]*models.PublicRoomEntry, len(rooms))
+	copy(sorted, rooms)
+	sort.Slice(sorted, func(i int, j int) bool {
+		return sorted[i].RoomID < sorted[j].RoomID
+	})
+
+	switch format {
+	case FormatJson:
+		return writeJson(w, sorted, fields)
+	case FormatCsv:
+		return writeCsv(w, sorted, fields)
+	case FormatNdjson:
+		return writeNdjson(w, sorted, fields)
+	default:
+		return errors.New("unknown export format: " + format)
+	}
+}
+
+func row(r *models.PublicRoomEntry, fields []string) map[string]interface{} {
+	// encoding/json sorts map keys, which gives us canonical output for free
+	m := make(map[string]interface{})
+	for _, f := range fields {
+		m[f] = fieldValues[f](r)
+	}
+	return m
+}
+
+func writeJson(w io.Writer, rooms []*models.PublicRoomEntry, fields []string) error {
+	rows := make([]map[string]interface{}, len(rooms))
+	for i, r := range rooms {
+		rows[i] = row(r, fields)
+	}
+
+	b, err := marshalCanonical(rows)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// writeNdjson flushes after each row if w can be flushed, so clients can start on the rows
+// before the export is finished.
+func writeNdjson(w io.Writer, rooms []*models.PublicRoomEntry, fields []string) error {
+	flusher, _ := w.(interface{ Flush() })
+	for _, r := range rooms {
+		b, err := marshalCanonical(row(r, fields))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		if err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	return nil
+}
+
+func writeCsv(w io.Writer, rooms []*models.PublicRoomEntry, fields []string) error {
+	c := csv.NewWriter(w)
+	err := c.Write(fields)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rooms {
+		record := make([]string, len(fields))
+		for i, f := range fields {
+			switch v := fieldValues[f](r).(type) {
+			case string:
+				record[i] = v
+			case int:
+				record[i] = strconv.Itoa(v)
+			case bool:
+				record[i] = strconv.FormatBool(v)
+			}
+		}
+		err = c.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Flush()
+	return c.Error()
+}
+
+// marshalCanonical encodes v as compact JSON without escaping HTML characters
+func marshalCanonical(v interface{}) ([]byte, error) {
+	buf := &strings.Builder{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSuffix(buf.String(), "\n")), nil
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/namsral/flag"
+	"github.com/t2bot/matrix-room-directory-server/config"
+)
+
+var defaults = config.Default()
+
+var (
+	configPath         = flag.String("config", "", "YAML config file to load. Flags and environment variables override values in the file.")
+	accessToken        = flag.String("accesstoken", defaults.Homeserver.AccessToken, "Access token to make homeserver API calls with")
+	hsUrl              = flag.String("hsurl", defaults.Homeserver.Url, "Homeserver to run against")
+	hsTimeout          = flag.Duration("hstimeout", defaults.Homeserver.Timeout, "How long to wait for each attempt at a homeserver API call")
+	hsRetries          = flag.Int("hsretries", defaults.Homeserver.MaxRetries, "How many times to retry a failed homeserver API call")
+	appserviceMode     = flag.Bool("appservice", defaults.Appservice.Enabled, "Run as an application service instead of using an access token")
+	asId               = flag.String("asid", defaults.Appservice.Id, "ID of the application service registration")
+	asUrl              = flag.String("asurl", defaults.Appservice.Url, "URL the homeserver can reach this server at to send transactions")
+	asToken            = flag.String("astoken", defaults.Appservice.AsToken, "Token to make homeserver API calls with in appservice mode")
+	hsToken            = flag.String("hstoken", defaults.Appservice.HsToken, "Token the homeserver uses to send transactions in appservice mode")
+	asBot              = flag.String("asbot", defaults.Appservice.SenderLocalpart, "Localpart of the appservice's bot user")
+	autoJoin           = flag.Bool("autojoin", defaults.Appservice.AutoJoin, "Join the bot to the public rooms in the space in appservice mode")
+	managementRoom     = flag.String("managementroom", defaults.Bot.ManagementRoom, "Room for curators to send the bot commands in. Requires appservice mode.")
+	botPowerLevel      = flag.Int("botpowerlevel", defaults.Bot.PowerLevel, "Power level in the space needed to send the bot commands")
+	enableSubmissions  = flag.Bool("submissions", defaults.Submissions.Enabled, "Let anyone propose rooms for the directory, for curators to review")
+	submissionBurst    = flag.Int("submissionburst", defaults.Submissions.RateLimit.Burst, "How many rooms each IP address can submit over HTTP at once")
+	submissionInterval = flag.Duration("submissioninterval", defaults.Submissions.RateLimit.Interval, "How often each IP address can submit another room over HTTP, once its burst is used up")
+	keyServerUrl       = flag.String("keyserver", defaults.KeyServer, "Key server to perform auth against")
+	spaceId            = flag.String("space", defaults.Space, "The Space to use as a room directory")
+	listenHost         = flag.String("address", defaults.Listen.Address, "Address to listen for requests on")
+	listenPort         = flag.Int("port", defaults.Listen.Port, "Port to listen for requests on")
+	listenSocket       = flag.String("socket", defaults.Listen.Socket, "Unix socket to listen for requests on instead of -address and -port")
+	socketPermissions  = flag.String("socketpermissions", defaults.Listen.SocketPermissions, "Octal file permissions for -socket")
+	tlsCert            = flag.String("tlscert", defaults.Listen.Tls.CertFile, "TLS certificate file to serve HTTPS with. Reloaded automatically when it changes.")
+	tlsKey             = flag.String("tlskey", defaults.Listen.Tls.KeyFile, "TLS private key file to serve HTTPS with")
+	tlsPort            = flag.Int("tlsport", defaults.Listen.Tls.Port, "Port to listen for HTTPS requests on")
+	tlsMinVersion      = flag.String("tlsminversion", defaults.Listen.Tls.MinVersion, "Minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)")
+	tlsOnly            = flag.Bool("tlsonly", defaults.Listen.Tls.Only, "Only serve HTTPS, without the plain HTTP port")
+	enableCors         = flag.Bool("cors", defaults.Cors.Enabled, "Send CORS headers so browsers can use the API directly")
+	corsOrigins        = flag.String("corsorigins", strings.Join(defaults.Cors.AllowedOrigins, ","), "Comma separated list of origins browsers may use the API from, or * for any")
+	enableAdmin        = flag.Bool("admin", defaults.Admin.Enabled, "Serve the admin API on a separate listener")
+	adminToken         = flag.String("admintoken", defaults.Admin.Token, "Bearer token required to use the admin API")
+	adminHost          = flag.String("adminaddress", defaults.Admin.Listen.Address, "Address to listen for admin API requests on")
+	adminPort          = flag.Int("adminport", defaults.Admin.Listen.Port, "Port to listen for admin API requests on")
+	adminSocket        = flag.String("adminsocket", defaults.Admin.Listen.Socket, "Unix socket to listen for admin API requests on instead of -adminaddress and -adminport")
+	maxSnapshotAge     = flag.Duration("maxsnapshotage", defaults.Health.MaxSnapshotAge, "How old the directory can get before /readyz reports the server as not ready")
+	enableAudit        = flag.Bool("audit", defaults.Audit.Enabled, "Record federation requests in the database. Requires -postgres.")
+	auditRetention     = flag.Duration("auditretention", defaults.Audit.Retention, "How long to keep federation requests in the audit log")
+	updateSpace        = flag.Bool("updatespace", defaults.UpdateSpaceOnUpgrade, "Update the Space's children when a listed room is upgraded")
+	fuzzyMaxEdits      = flag.Int("fuzzymaxedits", defaults.Search.FuzzyMaxEdits, "Maximum number of typos to tolerate per word when a search has no exact matches")
+	fuzzyMinSimilarity = flag.Float64("fuzzysimilarity", defaults.Search.FuzzyMinSimilarity, "Minimum trigram similarity (0-1) for a room name to fuzzily match a search")
+	enableWebsite      = flag.Bool("website", defaults.Website.Enabled, "Serve a public HTML version of the directory")
+	websiteTemplates   = flag.String("templates", defaults.Website.Templates, "Directory of HTML templates to override the website's built-in templates with")
+	enableExports      = flag.Bool("exports", defaults.Exports.Enabled, "Serve exports of the directory under /export")
+	enableFeeds        = flag.Bool("feeds", defaults.Feeds.Enabled, "Serve Atom and RSS feeds of newly listed rooms under /feeds")
+	postgres           = flag.String("postgres", defaults.Database.Postgres, "Postgres connection string. Required for webhooks.")
+	webhookUrls        = flag.String("webhooks", "", "Comma separated list of URLs to send webhooks to when the directory changes")
+	webhookSecret      = flag.String("webhooksecret", defaults.Webhooks.Secret, "Secret used to sign webhook payloads")
+	enableMetrics      = flag.Bool("metrics", defaults.Metrics.Enabled, "Serve Prometheus metrics at /metrics on the admin listener")
+	traceExporter      = flag.String("traceexporter", defaults.Tracing.Exporter, "Where to send OpenTelemetry traces: otlp, stdout (printed to stderr), or empty to disable tracing")
+	otlpEndpoint       = flag.String("otlpendpoint", defaults.Tracing.OtlpEndpoint, "OTLP/HTTP collector to send traces to, such as http://localhost:4318. Defaults to the standard OTEL_EXPORTER_OTLP_ENDPOINT behaviour.")
+	logFormat          = flag.String("logformat", defaults.Logging.Format, "Log format: text, json or logfmt")
+	logLevel           = flag.String("loglevel", defaults.Logging.Level, "Minimum level to log at: debug, info, warn or error")
+)
+
+func init() {
+	// The flag library would otherwise try to read -config as a file of flags itself
+	flag.DefaultConfigFlagname = ""
+}
+
+// applyFlags overrides the config file with any flags which were explicitly given,
+// either on the command line or through their environment variable.
+func applyFlags(c *config.Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "accesstoken":
+			c.Homeserver.AccessToken = *accessToken
+		case "hsurl":
+			c.Homeserver.Url = *hsUrl
+		case "hstimeout":
+			c.Homeserver.Timeout = *hsTimeout
+		case "hsretries":
+			c.Homeserver.MaxRetries = *hsRetries
+		case "appservice":
+			c.Appservice.Enabled = *appserviceMode
+		case "asid":
+			c.Appservice.Id = *asId
+		case "asurl":
+			c.Appservice.Url = *asUrl
+		case "astoken":
+			c.Appservice.AsToken = *asToken
+		case "hstoken":
+			c.Appservice.HsToken = *hsToken
+		case "asbot":
+			c.Appservice.SenderLocalpart = *asBot
+		case "autojoin":
+			c.Appservice.AutoJoin = *autoJoin
+		case "managementroom":
+			c.Bot.ManagementRoom = *managementRoom
+		case "botpowerlevel":
+			c.Bot.PowerLevel = *botPowerLevel
+		case "submissions":
+			c.Submissions.Enabled = *enableSubmissions
+		case "submissionburst":
+			c.Submissions.RateLimit.Burst = *submissionBurst
+		case "submissioninterval":
+			c.Submissions.RateLimit.Interval = *submissionInterval
+		case "keyserver":
+			c.KeyServer = *keyServerUrl
+		case "space":
+			c.Space = *spaceId
+		case "address":
+			c.Listen.Address = *listenHost
+		case "port":
+			c.Listen.Port = *listenPort
+		case "socket":
+			c.Listen.Socket = *listenSocket
+		case "socketpermissions":
+			c.Listen.SocketPermissions = *socketPermissions
+		case "tlscert":
+			c.Listen.Tls.CertFile = *tlsCert
+		case "tlskey":
+			c.Listen.Tls.KeyFile = *tlsKey
+		case "tlsport":
+			c.Listen.Tls.Port = *tlsPort
+		case "tlsminversion":
+			c.Listen.Tls.MinVersion = *tlsMinVersion
+		case "tlsonly":
+			c.Listen.Tls.Only = *tlsOnly
+		case "cors":
+			c.Cors.Enabled = *enableCors
+		case "corsorigins":
+			c.Cors.AllowedOrigins = make([]string, 0)
+			for _, o := range strings.Split(*corsOrigins, ",") {
+				if o = strings.TrimSpace(o); o != "" {
+					c.Cors.AllowedOrigins = append(c.Cors.AllowedOrigins, o)
+				}
+			}
+		case "admin":
+			c.Admin.Enabled = *enableAdmin
+		case "admintoken":
+			c.Admin.Token = *adminToken
+		case "adminaddress":
+			c.Admin.Listen.Address = *adminHost
+		case "adminport":
+			c.Admin.Listen.Port = *adminPort
+		case "adminsocket":
+			c.Admin.Listen.Socket = *adminSocket
+		case "maxsnapshotage":
+			c.Health.MaxSnapshotAge = *maxSnapshotAge
+		case "audit":
+			c.Audit.Enabled = *enableAudit
+		case "auditretention":
+			c.Audit.Retention = *auditRetention
+		case "updatespace":
+			c.UpdateSpaceOnUpgrade = *updateSpace
+		case "fuzzymaxedits":
+			c.Search.FuzzyMaxEdits = *fuzzyMaxEdits
+		case "fuzzysimilarity":
+			c.Search.FuzzyMinSimilarity = *fuzzyMinSimilarity
+		case "website":
+			c.Website.Enabled = *enableWebsite
+		case "templates":
+			c.Website.Templates = *websiteTemplates
+		case "exports":
+			c.Exports.Enabled = *enableExports
+		case "feeds":
+			c.Feeds.Enabled = *enableFeeds
+		case "postgres":
+			c.Database.Postgres = *postgres
+		case "webhooks":
+			c.Webhooks.Urls = make([]string, 0)
+			for _, u := range strings.Split(*webhookUrls, ",") {
+				if u = strings.TrimSpace(u); u != "" {
+					c.Webhooks.Urls = append(c.Webhooks.Urls, u)
+				}
+			}
+		case "webhooksecret":
+			c.Webhooks.Secret = *webhookSecret
+		case "metrics":
+			c.Metrics.Enabled = *enableMetrics
+		case "traceexporter":
+			c.Tracing.Exporter = *traceExporter
+		case "otlpendpoint":
+			c.Tracing.OtlpEndpoint = *otlpEndpoint
+		case "logformat":
+			c.Logging.Format = *logFormat
+		case "loglevel":
+			c.Logging.Level = *logLevel
+		}
+	})
+}
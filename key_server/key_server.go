@@ -1,5 +1,5 @@
 /*
- * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ * Copyright 2019 - 2022 Travis Ralston <travis@t2bot.io>
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -18,26 +18,34 @@ package key_server
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
+	"time"
+
+	"github.com/t2bot/matrix-room-directory-server/metrics"
+	"github.com/t2bot/matrix-room-directory-server/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type KeyServer struct {
 	url string
 }
 
-var Default *KeyServer
-
-func Setup(url string) {
-	Default = NewKeyServer(url)
-}
-
 func NewKeyServer(url string) *KeyServer {
 	return &KeyServer{url}
 }
 
-func (k *KeyServer) CheckAuth(authHeader string, urlMethod string, urlWithQuery string, destinationHost string, body []byte) error {
+func (k *KeyServer) CheckAuth(ctx context.Context, authHeader string, urlMethod string, urlWithQuery string, destinationHost string, body []byte) (err error) {
+	ctx, span := tracing.StartSpan(ctx, "KeyServer.CheckAuth", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+
 	contactPath := k.url + "/_matrix/key/unstable/check_auth"
 
 	var bodyStream io.Reader
@@ -45,7 +53,7 @@ func (k *KeyServer) CheckAuth(authHeader string, urlMethod string, urlWithQuery
 		bodyStream = bytes.NewBuffer(body)
 	}
 
-	req, err := http.NewRequest("POST", contactPath, bodyStream)
+	req, err := http.NewRequestWithContext(ctx, "POST", contactPath, bodyStream)
 	if err != nil {
 		return err
 	}
@@ -54,15 +62,44 @@ func (k *KeyServer) CheckAuth(authHeader string, urlMethod string, urlWithQuery
 	req.Header.Set("X-Keys-Method", urlMethod)
 	req.Header.Set("X-Keys-URI", urlWithQuery)
 	req.Header.Set("X-Keys-Destination", destinationHost)
+	tracing.Inject(ctx, req.Header)
 
+	start := time.Now()
 	r, err := http.DefaultClient.Do(req)
+	metrics.KeyServerDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.KeyServerAuth.WithLabelValues("error").Inc()
 		return err
 	}
+	defer r.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, r.Body)
 
 	if r.StatusCode != http.StatusOK {
+		metrics.KeyServerAuth.WithLabelValues("rejected").Inc()
+		span.SetAttributes(attribute.Int("http.status_code", r.StatusCode))
 		return errors.New("auth failed")
 	}
 
+	metrics.KeyServerAuth.WithLabelValues("success").Inc()
+	return nil
+}
+
+// Ping checks the key server is up by fetching its own keys.
+func (k *KeyServer) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", k.url+"/_matrix/key/v2/server", nil)
+	if err != nil {
+		return err
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, r.Body)
+
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", r.StatusCode)
+	}
 	return nil
 }
@@ -1,5 +1,5 @@
 /*
- * Copyright 2019 Travis Ralston <travis@t2bot.io>
+ * Copyright 2019 - 2022 Travis Ralston <travis@t2bot.io>
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -17,21 +17,56 @@
 package logging
 
 import (
+	"errors"
 	"os"
 
 	"github.com/sirupsen/logrus"
 )
 
-func Setup() {
-	logrus.SetFormatter(&utcFormatter{
-		&logrus.TextFormatter{
-			TimestampFormat:  "2006-01-02 15:04:05.000 Z07:00",
+const (
+	FormatText   = "text"
+	FormatJson   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+const timestampFormat = "2006-01-02 15:04:05.000 Z07:00"
+
+// Setup configures the global logger. The text format is coloured for humans, while
+// json and logfmt are meant for log collectors. Secrets are redacted in every format.
+func Setup(format string, level string) error {
+	var formatter logrus.Formatter
+	switch format {
+	case FormatText:
+		formatter = &logrus.TextFormatter{
+			TimestampFormat:  timestampFormat,
 			FullTimestamp:    true,
 			ForceColors:      true,
 			DisableColors:    false,
 			DisableTimestamp: false,
 			QuoteEmptyFields: true,
-		},
-	})
+		}
+	case FormatLogfmt:
+		formatter = &logrus.TextFormatter{
+			TimestampFormat:  timestampFormat,
+			FullTimestamp:    true,
+			DisableColors:    true,
+			QuoteEmptyFields: true,
+		}
+	case FormatJson:
+		formatter = &logrus.JSONFormatter{
+			TimestampFormat: timestampFormat,
+		}
+	default:
+		return errors.New("unknown log format: " + format)
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logrus.SetFormatter(&redactingFormatter{&utcFormatter{formatter}})
+	logrus.SetLevel(lvl)
 	logrus.SetOutput(os.Stdout)
+	return nil
 }
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const redacted = "[redacted]"
+
+var sensitiveFields = map[string]bool{
+	"authorization": true,
+	"access_token":  true,
+	"accesstoken":   true,
+	"as_token":      true,
+	"hs_token":      true,
+	"token":         true,
+	"secret":        true,
+}
+
+var sensitivePatterns = []*regexp.Regexp{
+	// Authorization header values, such as "Bearer syt_..." or `X-Matrix origin="...",sig="..."`.
+	// X-Matrix values are quoted and may contain spaces, so everything to the end of the
+	// line is removed.
+	regexp.MustCompile(`(?i)(Bearer|X-Matrix)\s+[^\r\n]+`),
+	// Query strings and JSON bodies
+	regexp.MustCompile(`(?i)((?:access|as|hs)_token=)[^&\s"']+`),
+	regexp.MustCompile(`(?i)("(?:access|as|hs)_token"\s*:\s*")[^"]*`),
+}
+
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	// The entry's data may be shared with other entries, so work on a copy
+	data := make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if sensitiveFields[strings.ToLower(k)] {
+			data[k] = redacted
+		} else if s, ok := v.(string); ok {
+			data[k] = Redact(s)
+		} else if err, ok := v.(error); ok {
+			data[k] = Redact(err.Error())
+		} else {
+			data[k] = v
+		}
+	}
+
+	clone := *entry
+	clone.Data = data
+	clone.Message = Redact(entry.Message)
+	return f.Formatter.Format(&clone)
+}
+
+// Redact removes access tokens and Authorization header values from the given text.
+func Redact(s string) string {
+	for i, pattern := range sensitivePatterns {
+		if i == 0 {
+			s = pattern.ReplaceAllString(s, "$1 "+redacted)
+		} else {
+			s = pattern.ReplaceAllString(s, "${1}"+redacted)
+		}
+	}
+	return s
+}
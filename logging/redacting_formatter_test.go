@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package logging
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "bearer token",
+			input:    "Authorization: Bearer syt_abc123",
+			expected: "Authorization: Bearer [redacted]",
+		},
+		{
+			name:     "quoted x-matrix header",
+			input:    `Authorization: X-Matrix origin="example.org",key="ed25519:abc",sig="c2lnbmF0dXJl"`,
+			expected: "Authorization: X-Matrix [redacted]",
+		},
+		{
+			name:     "x-matrix header with spaces",
+			input:    `X-Matrix origin=example.org, key="ed25519:abc", sig="c2lnbmF0dXJl"`,
+			expected: "X-Matrix [redacted]",
+		},
+		{
+			name:     "only the header's line",
+			input:    "Authorization: X-Matrix origin=example.org,sig=abc\nHost: example.org",
+			expected: "Authorization: X-Matrix [redacted]\nHost: example.org",
+		},
+		{
+			name:     "query string",
+			input:    "GET /_matrix/app/v1/users/@a:b?access_token=secret&user_id=@a:b",
+			expected: "GET /_matrix/app/v1/users/@a:b?access_token=[redacted]&user_id=@a:b",
+		},
+		{
+			name:     "json body",
+			input:    `{"as_token": "secret", "url": "http://localhost"}`,
+			expected: `{"as_token": "[redacted]", "url": "http://localhost"}`,
+		},
+		{
+			name:     "nothing sensitive",
+			input:    "Refreshed 42 rooms",
+			expected: "Refreshed 42 rooms",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := Redact(c.input); actual != c.expected {
+				t.Errorf("expected %q, got %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRedactingFormatter(t *testing.T) {
+	f := redactingFormatter{&logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}}
+	entry := logrus.WithFields(logrus.Fields{
+		"access_token": "syt_field",
+		"header":       `X-Matrix origin="example.org",key="ed25519:abc",sig="c2lnbmF0dXJl"`,
+		"error":        errors.New("request with Bearer syt_error failed"),
+	})
+	entry.Message = "Calling homeserver with Bearer syt_message"
+
+	b, err := f.Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	for _, secret := range []string{"syt_field", "example.org", "ed25519:abc", "c2lnbmF0dXJl", "syt_error", "syt_message"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%q was not redacted from %q", secret, out)
+		}
+	}
+
+	if entry.Data["access_token"] != "syt_field" {
+		t.Error("formatting modified the original entry")
+	}
+}
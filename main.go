@@ -17,58 +17,225 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"os"
+
 	"github.com/namsral/flag"
 	"github.com/t2bot/matrix-room-directory-server/api"
-	"github.com/t2bot/matrix-room-directory-server/common"
+	"github.com/t2bot/matrix-room-directory-server/api/admin"
+	appsvcapi "github.com/t2bot/matrix-room-directory-server/api/appservice"
+	"github.com/t2bot/matrix-room-directory-server/api/health"
+	subsapi "github.com/t2bot/matrix-room-directory-server/api/submissions"
+	"github.com/t2bot/matrix-room-directory-server/api/web"
+	"github.com/t2bot/matrix-room-directory-server/appservice"
+	"github.com/t2bot/matrix-room-directory-server/audit"
+	"github.com/t2bot/matrix-room-directory-server/bot"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/database"
 	"github.com/t2bot/matrix-room-directory-server/directory"
 	"github.com/t2bot/matrix-room-directory-server/key_server"
 	"github.com/t2bot/matrix-room-directory-server/matrix"
+	"github.com/t2bot/matrix-room-directory-server/submissions"
+	"github.com/t2bot/matrix-room-directory-server/tracing"
+	"github.com/t2bot/matrix-room-directory-server/webhooks"
 
 	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-room-directory-server/logging"
 )
 
 func main() {
-	logging.Setup()
+	flag.Parse()
+
+	isExport := flag.Arg(0) == "export"
+	isGenerateRegistration := flag.Arg(0) == "generate-registration"
+
+	overrides := applyFlags
+	if isGenerateRegistration {
+		overrides = func(c *config.Config) {
+			applyFlags(c)
+			fillRegistrationTokens(c)
+		}
+	}
+
+	cfg, err := config.Load(*configPath, overrides)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config.Set(cfg)
+
+	err = logging.Setup(cfg.Logging.Format, cfg.Logging.Level)
+	if err != nil {
+		panic(err)
+	}
+
+	// Subcommands write to stdout, so keep the logs out of the way
+	if isExport || isGenerateRegistration {
+		logrus.SetOutput(os.Stderr)
+	}
+
+	if isGenerateRegistration {
+		err = runGenerateRegistration(cfg, flag.Args()[1:])
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
 	logrus.Info("Starting up...")
 
-	accessToken := flag.String("accesstoken", "", "Access token to make homeserver API calls with")
-	hsUrl := flag.String("hsurl", "https://t2bot.io", "Homeserver to run against")
-	keyServerUrl := flag.String("keyserver", "https://keys.t2host.io", "Key server to perform auth against")
-	spaceId := flag.String("space", "#directory:t2bot.io", "The Space to use as a room directory")
-	listenHost := flag.String("address", "0.0.0.0", "Address to listen for requests on")
-	listenPort := flag.Int("port", 8080, "Port to listen for requests on")
-	flag.Parse()
+	logrus.Info("Homeserver URL: ", cfg.Homeserver.Url)
+	logrus.Info("Space ID: ", cfg.Space)
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing.Exporter, cfg.Tracing.OtlpEndpoint)
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
+	accessToken := cfg.Homeserver.AccessToken
+	if cfg.Appservice.Enabled {
+		logrus.Info("Running as an appservice")
+		accessToken = cfg.Appservice.AsToken
+	}
+	client := matrix.NewClient(cfg.Homeserver.Url, accessToken, matrix.Options{
+		Timeout:    cfg.Homeserver.Timeout,
+		MaxRetries: cfg.Homeserver.MaxRetries,
+	})
+	dir := directory.NewService(client, cfg.Space)
+
+	if cfg.Database.Postgres != "" {
+		logrus.Info("Connecting to database...")
+		err := database.Setup(cfg.Database.Postgres)
+		if err != nil {
+			panic(err)
+		}
 
-	logrus.Info("Setting common variables...")
-	common.AccessToken = *accessToken
-	common.HomeserverUrl = *hsUrl
-	common.SpaceId = *spaceId
+		logrus.Info("Loading room overrides...")
+		err = dir.UseOverrideStore(directory.NewSqlOverrideStore(database.Get()))
+		if err != nil {
+			panic(err)
+		}
 
-	logrus.Info("Homeserver URL: ", common.HomeserverUrl)
-	logrus.Info("Space ID: ", common.SpaceId)
+		logrus.Info("Loading recent changes...")
+		err = dir.UseChangeStore(directory.NewSqlChangeStore(database.Get()))
+		if err != nil {
+			panic(err)
+		}
+
+		if !isExport {
+			logrus.Info("Setting up webhooks...")
+			webhooks.Setup(dir)
+			webhooks.BeginDelivering()
+			defer webhooks.Stop()
+		}
+	}
+
+	if cfg.Appservice.Enabled {
+		logrus.Info("Joining the space...")
+		err = client.JoinRoom(context.Background(), cfg.Space, nil)
+		if err != nil {
+			// The space might still be readable if it's public, so carry on
+			logrus.Warn("Error joining the space: ", err)
+		}
+	}
 
 	logrus.Info("Resolving Space ID to Room ID...")
-	rid, err := matrix.ResolveRoom(common.SpaceId)
+	rid, err := client.ResolveRoom(context.Background(), cfg.Space)
 	if err != nil {
 		panic(err)
 	}
-	common.SpaceId = rid
-	logrus.Info("Space ID (revised): ", common.SpaceId)
+	dir.Configure(rid, cfg.UpdateSpaceOnUpgrade)
+	logrus.Info("Space ID (revised): ", rid)
 
 	logrus.Info("Seeing cache...")
-	err = directory.DoUpdate()
+	err = dir.DoUpdate()
 	if err != nil {
 		panic(err)
 	}
 
-	logrus.Info("Setting up key server...")
-	key_server.Setup(*keyServerUrl)
+	if isExport {
+		err = runExport(dir, flag.Args()[1:])
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		return
+	}
+
+	keyServer := key_server.NewKeyServer(cfg.KeyServer)
+	services := &api.Services{
+		Config:    config.Get,
+		Directory: dir,
+		Auth:      keyServer,
+		Readiness: &health.Handlers{
+			Checks: map[string]health.Check{
+				"homeserver": func(ctx context.Context) error {
+					_, err := client.Whoami(ctx)
+					return err
+				},
+				"key_server": keyServer.Ping,
+				"snapshot":   health.SnapshotCheck(dir, cfg.Health.MaxSnapshotAge),
+			},
+			CacheFor: health.DefaultCacheFor,
+		},
+	}
+	if database.IsConfigured() {
+		services.Readiness.Checks["database"] = database.Get().PingContext
+	}
+	if cfg.Audit.Enabled {
+		logrus.Info("Starting audit log...")
+		services.Audit = audit.NewLog(database.Get(), cfg.Audit.Retention)
+		services.Audit.BeginRecording()
+		defer services.Audit.Stop()
+	}
+
+	if cfg.Appservice.Enabled {
+		services.Appservice = appsvcapi.NewHandlers(cfg.Appservice.HsToken, dir)
+		if cfg.Appservice.AutoJoin {
+			logrus.Info("Auto-joining rooms in the space...")
+			appservice.AutoJoin(dir)
+		}
+
+		if cfg.Bot.ManagementRoom != "" {
+			logrus.Info("Joining management room...")
+			err = client.JoinRoom(context.Background(), cfg.Bot.ManagementRoom, nil)
+			if err != nil {
+				panic(err)
+			}
+			managementRoomId, err := client.ResolveRoom(context.Background(), cfg.Bot.ManagementRoom)
+			if err != nil {
+				panic(err)
+			}
+			if !database.IsConfigured() {
+				logrus.Warn("No database is configured, so hidden rooms and overrides will be forgotten on restart")
+			}
+			var subs *submissions.Service
+			if cfg.Submissions.Enabled {
+				subs = submissions.NewService(dir, database.Get(), managementRoomId)
+				services.Submissions = subsapi.NewHandlers(config.Get, subs)
+			}
+			services.Appservice.Events = bot.NewBot(dir, subs, managementRoomId, cfg.Bot.PowerLevel)
+		}
+	}
+
+	if cfg.Website.Enabled {
+		logrus.Info("Loading website templates...")
+		services.Website, err = web.NewHandlers(config.Get, dir, cfg.Website.Templates)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	logrus.Info("Starting app...")
-	directory.BeginCaching()
-	api.Run(*listenHost, *listenPort)
+	dir.BeginCaching()
+	watchForReload(dir)
+	if cfg.Admin.Enabled {
+		services.Admin = &admin.Handlers{Token: cfg.Admin.Token, Directory: dir, Audit: services.Audit}
+		go api.Run(cfg.Admin.Listen, api.NewAdminRouter(services))
+	}
+	api.Run(cfg.Listen, api.NewRouter(services))
 
 	logrus.Info("Stopping...")
-	directory.Stop()
+	dir.Stop()
 }
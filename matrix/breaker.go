@@ -0,0 +1,81 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package matrix
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops requests to the homeserver after a run of failures. Once the
+// cooldown has passed, a single request is let through to probe whether the homeserver
+// has recovered: if it succeeds the breaker closes again, otherwise it stays open for
+// another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be made. Every allowed request must be followed
+// by a call to success, failure or release.
+func (b *circuitBreaker) allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *circuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *circuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// release ends a request which says nothing about the homeserver's health, such as one
+// cancelled by the caller.
+func (b *circuitBreaker) release() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.probing = false
+}
@@ -17,52 +17,156 @@
 package matrix
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/t2bot/matrix-room-directory-server/common"
+	"github.com/sirupsen/logrus"
 	"github.com/t2bot/matrix-room-directory-server/models"
+	"github.com/t2bot/matrix-room-directory-server/tracing"
+	"github.com/t2bot/matrix-room-directory-server/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type directoryLookupResponse struct {
 	RoomId string `json:"room_id"`
 }
 
-type spaceHierarchyResponse struct {
-	Chunk     []*models.PublicRoomEntry `json:"rooms"`
-	NextBatch string                    `json:"next_batch"`
+type whoamiResponse struct {
+	UserId string `json:"user_id"`
 }
 
-func ResolveRoom(roomAlias string) (string, error) {
+type createRoomResponse struct {
+	RoomId string `json:"room_id"`
+}
+
+type joinedRoomsResponse struct {
+	JoinedRooms []string `json:"joined_rooms"`
+}
+
+const (
+	baseBackoff      = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+	maxRetryAfter    = 1 * time.Minute
+	breakerThreshold = 5
+	breakerCooldown  = 30 * time.Second
+)
+
+// Options control how a Client copes with a slow or failing homeserver.
+type Options struct {
+	// Timeout is the longest a single attempt at a request may take.
+	Timeout time.Duration
+
+	// MaxRetries is how many times a request is retried after a network error, a 5xx
+	// or being rate limited.
+	MaxRetries int
+}
+
+// Client calls the client-server API of a homeserver as a single user.
+type Client struct {
+	homeserverUrl string
+	accessToken   string
+	options       Options
+	httpClient    *http.Client
+	breaker       *circuitBreaker
+
+	supportLock     sync.Mutex
+	supported       *serverSupport
+	supportFailedAt time.Time
+}
+
+// NewClient creates a client for the homeserver at the given URL, authenticating with
+// the access token.
+func NewClient(homeserverUrl string, accessToken string, options Options) *Client {
+	return &Client{
+		homeserverUrl: homeserverUrl,
+		accessToken:   accessToken,
+		options:       options,
+		httpClient:    &http.Client{},
+		breaker:       newCircuitBreaker(breakerThreshold, breakerCooldown),
+	}
+}
+
+func (c *Client) ResolveRoom(ctx context.Context, roomAlias string) (string, error) {
 	if roomAlias[0] == '!' {
 		return roomAlias, nil
 	}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/_matrix/client/r0/directory/room/%s", common.HomeserverUrl, url.QueryEscape(roomAlias)), nil)
+	j := directoryLookupResponse{}
+	err := c.doRequest(ctx, "matrix.ResolveRoom", "GET", c.clientPath(ctx, fmt.Sprintf("/directory/room/%s", url.PathEscape(roomAlias))), nil, &j)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Authorization", "Bearer "+common.AccessToken)
 
-	res, err := http.DefaultClient.Do(req)
+	return j.RoomId, nil
+}
+
+func (c *Client) GetHierarchy(ctx context.Context, roomId string) ([]*models.PublicRoomEntry, error) {
+	return c.hierarchy(ctx, "matrix.GetHierarchy", roomId, 1000, 10)
+}
+
+// Whoami returns the user ID the client is authenticated as. It fails if the access
+// token isn't valid.
+func (c *Client) Whoami(ctx context.Context) (string, error) {
+	j := whoamiResponse{}
+	err := c.doRequest(ctx, "matrix.Whoami", "GET", c.clientPath(ctx, "/account/whoami"), nil, &j)
 	if err != nil {
 		return "", err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return "", errors.New(fmt.Sprintf("unexpected status code %d", res.StatusCode))
-	}
+	return j.UserId, nil
+}
 
-	b, err := ioutil.ReadAll(res.Body)
+// GetStateEvent returns the content of the given state event, or nil if the
+// event does not exist in the room.
+func (c *Client) GetStateEvent(ctx context.Context, roomId string, eventType string, stateKey string) (map[string]interface{}, error) {
+	j := make(map[string]interface{})
+	err := c.doRequest(ctx, "matrix.GetStateEvent", "GET", c.clientPath(ctx, fmt.Sprintf("/rooms/%s/state/%s/%s", url.PathEscape(roomId), url.PathEscape(eventType), url.PathEscape(stateKey))), nil, &j)
+	if IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	j := directoryLookupResponse{}
-	err = json.Unmarshal(b, &j)
+	return j, nil
+}
+
+// SendStateEvent sets a state event in the given room.
+func (c *Client) SendStateEvent(ctx context.Context, roomId string, eventType string, stateKey string, content map[string]interface{}) error {
+	return c.doRequest(ctx, "matrix.SendStateEvent", "PUT", c.clientPath(ctx, fmt.Sprintf("/rooms/%s/state/%s/%s", url.PathEscape(roomId), url.PathEscape(eventType), url.PathEscape(stateKey))), content, nil)
+}
+
+// SendNotice sends a plain text m.notice to the given room.
+func (c *Client) SendNotice(ctx context.Context, roomId string, text string) error {
+	content := map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    text,
+	}
+	path := c.clientPath(ctx, fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(roomId), util.RandomString(8)))
+	return c.doRequest(ctx, "matrix.SendNotice", "PUT", path, content, nil)
+}
+
+// CreateDirectRoom creates a private room with the given user invited, marked as a
+// direct chat, returning its room ID.
+func (c *Client) CreateDirectRoom(ctx context.Context, userId string) (string, error) {
+	body := map[string]interface{}{
+		"preset":    "trusted_private_chat",
+		"is_direct": true,
+		"invite":    []string{userId},
+	}
+	j := createRoomResponse{}
+	err := c.doRequestOnce(ctx, "matrix.CreateRoom", "POST", c.clientPath(ctx, "/createRoom"), body, &j)
 	if err != nil {
 		return "", err
 	}
@@ -70,32 +174,240 @@ func ResolveRoom(roomAlias string) (string, error) {
 	return j.RoomId, nil
 }
 
-func GetHierarchy(roomId string) ([]*models.PublicRoomEntry, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/_matrix/client/v1/rooms/%s/hierarchy?limit=1000&max_depth=10", common.HomeserverUrl, url.QueryEscape(roomId)), nil)
+// JoinRoom joins the given room, trying the given servers to join through if the
+// homeserver isn't already in the room.
+func (c *Client) JoinRoom(ctx context.Context, roomIdOrAlias string, via []string) error {
+	query := url.Values{}
+	for _, server := range via {
+		query.Add("server_name", server)
+	}
+	path := c.clientPath(ctx, fmt.Sprintf("/join/%s", url.PathEscape(roomIdOrAlias)))
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.doRequest(ctx, "matrix.JoinRoom", "POST", path, map[string]interface{}{}, nil)
+}
+
+// JoinedRooms returns the IDs of the rooms the user is joined to.
+func (c *Client) JoinedRooms(ctx context.Context) ([]string, error) {
+	j := joinedRoomsResponse{}
+	err := c.doRequest(ctx, "matrix.JoinedRooms", "GET", c.clientPath(ctx, "/joined_rooms"), nil, &j)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", "Bearer "+common.AccessToken)
 
-	res, err := http.DefaultClient.Do(req)
+	return j.JoinedRooms, nil
+}
+
+// GetRoomSummary returns the hierarchy entry for a single room, without
+// descending into its children.
+func (c *Client) GetRoomSummary(ctx context.Context, roomId string) (*models.PublicRoomEntry, error) {
+	rooms, err := c.hierarchy(ctx, "matrix.GetRoomSummary", roomId, 1, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return nil, errors.New(fmt.Sprintf("unexpected status code %d", res.StatusCode))
+	for _, r := range rooms {
+		if r.RoomID == roomId {
+			return r, nil
+		}
 	}
 
-	b, err := ioutil.ReadAll(res.Body)
+	return nil, errors.New("room not found in hierarchy response")
+}
+
+// GetThumbnail downloads a thumbnail of the media, cropped to size by size pixels. The
+// homeserver may send a larger one if it doesn't have that size.
+func (c *Client) GetThumbnail(ctx context.Context, server string, mediaId string, size int) ([]byte, error) {
+	path := c.mediaPath(ctx, fmt.Sprintf("/thumbnail/%s/%s?width=%d&height=%d&method=crop", url.PathEscape(server), url.PathEscape(mediaId), size, size))
+	b := make([]byte, 0)
+	err := c.doRequest(ctx, "matrix.GetThumbnail", "GET", path, nil, &b)
+	return b, err
+}
+
+// doRequest calls the homeserver's client-server API, decoding the JSON response into
+// result if it is not nil, or copying the body as it is if result is a *[]byte. Failed
+// attempts are retried with backoff where that might help, and the whole call is traced
+// as a single span. POST requests aren't idempotent, so they are only retried when the
+// homeserver rate limited them without acting on them.
+func (c *Client) doRequest(ctx context.Context, spanName string, method string, path string, body interface{}, result interface{}) error {
+	return c.request(ctx, spanName, method, path, body, result, c.options.MaxRetries)
+}
+
+// doRequestOnce is doRequest without retries, for requests which would have an effect
+// twice if the first attempt succeeded but its response was lost, such as creating a room.
+func (c *Client) doRequestOnce(ctx context.Context, spanName string, method string, path string, body interface{}, result interface{}) error {
+	return c.request(ctx, spanName, method, path, body, result, 0)
+}
+
+func (c *Client) request(ctx context.Context, spanName string, method string, path string, body interface{}, result interface{}, maxRetries int) (err error) {
+	ctx, span := tracing.StartSpan(ctx, spanName, trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		tracing.EndSpan(span, err)
+	}()
+	span.SetAttributes(attribute.String("http.method", method), attribute.String("http.url", c.homeserverUrl+path))
+
+	var b []byte
+	if body != nil {
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The breaker counts calls rather than attempts, so that one call retrying through
+	// a blip doesn't open it by itself.
+	if !c.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	defer func() {
+		c.recordOutcome(ctx, err)
+	}()
+
+	idempotent := method != http.MethodPost
+	for attempt := 0; ; attempt++ {
+		var res []byte
+		res, err = c.send(ctx, method, path, b)
+		if err == nil {
+			if raw, ok := result.(*[]byte); ok {
+				*raw = res
+				return nil
+			}
+			if result != nil {
+				return json.Unmarshal(res, result)
+			}
+			return nil
+		}
+
+		delay, retry := retryDelay(attempt, maxRetries, idempotent, err)
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"method":  method,
+			"path":    path,
+			"attempt": attempt + 1,
+		}).Warnf("Error calling homeserver, retrying in %s: %v", delay, err)
+		span.SetAttributes(attribute.Int("http.retries", attempt+1))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// recordOutcome tells the circuit breaker how a call to the homeserver went.
+func (c *Client) recordOutcome(ctx context.Context, err error) {
+	var matrixErr *Error
+	if errors.As(err, &matrixErr) && matrixErr.StatusCode < 500 {
+		// The homeserver is up, it just didn't like the request
+		c.breaker.success()
+	} else if err != nil && ctx.Err() != nil {
+		c.breaker.release()
+	} else if err != nil {
+		c.breaker.failure()
+	} else {
+		c.breaker.success()
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, path string, body []byte) ([]byte, error) {
+	if c.options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.options.Timeout)
+		defer cancel()
+	}
+
+	var bodyStream io.Reader
+	if body != nil {
+		bodyStream = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.homeserverUrl+path, bodyStream)
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	tracing.Inject(ctx, req.Header)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
 
-	j := spaceHierarchyResponse{}
-	err = json.Unmarshal(b, &j)
+	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	return j.Chunk, nil
+	if res.StatusCode != http.StatusOK {
+		matrixErr := parseError(res.StatusCode, b)
+		if matrixErr.RetryAfterMs <= 0 {
+			matrixErr.RetryAfterMs = parseRetryAfter(res.Header.Get("Retry-After")).Milliseconds()
+		}
+		return nil, matrixErr
+	}
+	return b, nil
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or
+// an HTTP date. It returns zero if the header is missing or invalid.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(header, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		if seconds > int64(maxRetryAfter/time.Second) {
+			// Too long to wait out either way, and huge values would overflow
+			return maxRetryAfter + time.Second
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+// retryDelay decides whether a failed attempt is worth retrying, and how long to wait
+// first. Rate limits are waited out for as long as the homeserver asks, within reason.
+// Other failures are only retried for idempotent requests, as the homeserver may have
+// acted on the request before failing.
+func retryDelay(attempt int, maxRetries int, idempotent bool, err error) (time.Duration, bool) {
+	if attempt >= maxRetries || errors.Is(err, ErrCircuitOpen) {
+		return 0, false
+	}
+
+	var matrixErr *Error
+	if errors.As(err, &matrixErr) && (matrixErr.StatusCode == http.StatusTooManyRequests || matrixErr.ErrCode == ErrCodeLimitExceeded) {
+		if retryAfter := matrixErr.RetryAfter(); retryAfter > 0 {
+			return retryAfter, retryAfter <= maxRetryAfter
+		}
+		return backoff(attempt), true
+	}
+	if !idempotent || (matrixErr != nil && matrixErr.StatusCode < 500) {
+		return 0, false
+	}
+
+	return backoff(attempt), true
+}
+
+// backoff doubles the delay for each failed attempt, picking a random delay up to that
+// so that many callers don't retry in lockstep.
+func backoff(attempt int) time.Duration {
+	delay := baseBackoff << attempt
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
 }
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	ErrCodeForbidden     = "M_FORBIDDEN"
+	ErrCodeNotFound      = "M_NOT_FOUND"
+	ErrCodeUnknownToken  = "M_UNKNOWN_TOKEN"
+	ErrCodeLimitExceeded = "M_LIMIT_EXCEEDED"
+	ErrCodeUnrecognized  = "M_UNRECOGNIZED"
+)
+
+// ErrCircuitOpen is returned without contacting the homeserver while it is considered
+// down, after too many consecutive failures.
+var ErrCircuitOpen = errors.New("homeserver is unavailable, not sending requests until it recovers")
+
+// Error is an error response from the homeserver. ErrCode and Message are empty if the
+// response body wasn't a standard Matrix error.
+type Error struct {
+	StatusCode   int    `json:"-"`
+	ErrCode      string `json:"errcode"`
+	Message      string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
+
+func (e *Error) Error() string {
+	if e.ErrCode == "" {
+		return fmt.Sprintf("unexpected status code %d", e.StatusCode)
+	}
+	return fmt.Sprintf("%s (%d): %s", e.ErrCode, e.StatusCode, e.Message)
+}
+
+// RetryAfter is how long the homeserver asked us to wait before trying again, or zero
+// if it didn't say.
+func (e *Error) RetryAfter() time.Duration {
+	return time.Duration(e.RetryAfterMs) * time.Millisecond
+}
+
+func parseError(statusCode int, body []byte) *Error {
+	e := &Error{}
+	if json.Unmarshal(body, e) != nil {
+		e = &Error{}
+	}
+	e.StatusCode = statusCode
+	return e
+}
+
+// IsNotFound returns true if the error is a 404 from the homeserver.
+func IsNotFound(err error) bool {
+	var matrixErr *Error
+	return errors.As(err, &matrixErr) && matrixErr.StatusCode == 404
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package matrix
+
+// Event is a room event, such as those pushed to an appservice.
+type Event struct {
+	Type     string                 `json:"type"`
+	RoomId   string                 `json:"room_id"`
+	Sender   string                 `json:"sender"`
+	EventId  string                 `json:"event_id"`
+	StateKey *string                `json:"state_key,omitempty"`
+	Content  map[string]interface{} `json:"content"`
+}
+
+// IsState returns whether the event is a state event.
+func (e *Event) IsState() bool {
+	return e.StateKey != nil
+}
@@ -0,0 +1,193 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package matrix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+type spaceHierarchyResponse struct {
+	Chunk     []*models.PublicRoomEntry `json:"rooms"`
+	NextBatch string                    `json:"next_batch"`
+}
+
+// hierarchy returns the rooms in a space down to maxDepth, starting with the space
+// itself. The stable and unstable (MSC2946) hierarchy APIs are tried in order of what
+// the homeserver advertises, and if it supports neither, the space's state is walked
+// instead.
+func (c *Client) hierarchy(ctx context.Context, spanName string, roomId string, limit int, maxDepth int) ([]*models.PublicRoomEntry, error) {
+	s := c.support(ctx)
+
+	prefixes := make([]string, 0, 2)
+	if s.stableHierarchy || !s.unstableHierarchy {
+		prefixes = append(prefixes, "/_matrix/client/v1")
+	}
+	if s.unstableHierarchy || !s.stableHierarchy {
+		prefixes = append(prefixes, "/_matrix/client/unstable/"+msc2946Feature)
+	}
+
+	for _, prefix := range prefixes {
+		rooms, err := c.hierarchyPages(ctx, spanName, prefix, roomId, limit, maxDepth)
+		if err == nil {
+			return rooms, nil
+		}
+		if !isUnrecognized(err) {
+			return nil, err
+		}
+		logrus.WithField("prefix", prefix).Debug("Homeserver does not support hierarchy API: ", err)
+	}
+
+	logrus.Debug("Homeserver has no hierarchy API, walking space state instead")
+	return c.walkSpace(ctx, roomId, limit, maxDepth)
+}
+
+// hierarchyPages reads the hierarchy from one of the hierarchy APIs, following next_batch
+// until there are no more pages or limit rooms have been read. A page with no rooms or a
+// repeated next_batch also ends it, so a misbehaving homeserver can't keep us looping.
+func (c *Client) hierarchyPages(ctx context.Context, spanName string, prefix string, roomId string, limit int, maxDepth int) ([]*models.PublicRoomEntry, error) {
+	rooms := make([]*models.PublicRoomEntry, 0)
+	from := ""
+	for {
+		path := fmt.Sprintf("%s/rooms/%s/hierarchy?limit=%d&max_depth=%d", prefix, url.PathEscape(roomId), limit, maxDepth)
+		if from != "" {
+			path += "&from=" + url.QueryEscape(from)
+		}
+
+		j := spaceHierarchyResponse{}
+		err := c.doRequest(ctx, spanName, "GET", path, nil, &j)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, j.Chunk...)
+
+		if j.NextBatch == "" || j.NextBatch == from || len(j.Chunk) == 0 || len(rooms) >= limit {
+			break
+		}
+		from = j.NextBatch
+	}
+
+	if len(rooms) > limit {
+		rooms = rooms[:limit]
+	}
+	return rooms, nil
+}
+
+// walkSpace builds the hierarchy of a space from the m.space.child state events of the
+// space and its subspaces. Only rooms whose state the user can read are included.
+func (c *Client) walkSpace(ctx context.Context, roomId string, limit int, maxDepth int) ([]*models.PublicRoomEntry, error) {
+	type queued struct {
+		roomId string
+		depth  int
+	}
+
+	rooms := make([]*models.PublicRoomEntry, 0)
+	seen := map[string]bool{roomId: true}
+	queue := []queued{{roomId, 0}}
+	for len(queue) > 0 && len(rooms) < limit {
+		next := queue[0]
+		queue = queue[1:]
+
+		r, err := c.roomFromState(ctx, next.roomId)
+		if err != nil {
+			if next.roomId == roomId {
+				return nil, err
+			}
+			// Most commonly we're not joined to the room, which the hierarchy API would
+			// also have left out
+			logrus.WithField("room_id", next.roomId).Debug("Unable to read room state, leaving it out: ", err)
+			continue
+		}
+		rooms = append(rooms, r)
+
+		if next.depth >= maxDepth {
+			continue
+		}
+		for _, child := range r.ChildrenState {
+			if !seen[child.StateKey] {
+				seen[child.StateKey] = true
+				queue = append(queue, queued{child.StateKey, next.depth + 1})
+			}
+		}
+	}
+
+	return rooms, nil
+}
+
+// roomFromState builds a hierarchy entry for a room from its current state.
+func (c *Client) roomFromState(ctx context.Context, roomId string) (*models.PublicRoomEntry, error) {
+	events := make([]*models.ChildrenState, 0)
+	err := c.doRequest(ctx, "matrix.GetRoomState", "GET", c.clientPath(ctx, fmt.Sprintf("/rooms/%s/state", url.PathEscape(roomId))), nil, &events)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &models.PublicRoomEntry{
+		RoomID:        roomId,
+		ChildrenState: make([]*models.ChildrenState, 0),
+	}
+	for _, ev := range events {
+		switch ev.Type {
+		case "m.room.create":
+			r.RoomType, _ = ev.Content["type"].(string)
+		case "m.room.name":
+			r.Name, _ = ev.Content["name"].(string)
+		case "m.room.topic":
+			r.Topic, _ = ev.Content["topic"].(string)
+		case "m.room.canonical_alias":
+			r.CanonicalAlias, _ = ev.Content["alias"].(string)
+		case "m.room.avatar":
+			r.AvatarUrl, _ = ev.Content["url"].(string)
+		case "m.room.join_rules":
+			r.JoinRule, _ = ev.Content["join_rule"].(string)
+		case "m.room.history_visibility":
+			r.WorldReadable = ev.Content["history_visibility"] == "world_readable"
+		case "m.room.guest_access":
+			r.GuestsAllowed = ev.Content["guest_access"] == "can_join"
+		case "m.room.member":
+			if ev.Content["membership"] == "join" {
+				r.JoinedCount++
+			}
+		case "m.space.child":
+			// Children are removed by emptying the event's content
+			if len(ev.Content) > 0 {
+				r.ChildrenState = append(r.ChildrenState, ev)
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// isUnrecognized returns true if the error means the homeserver doesn't have the
+// endpoint at all, rather than the request failing.
+func isUnrecognized(err error) bool {
+	var matrixErr *Error
+	if !errors.As(err, &matrixErr) {
+		return false
+	}
+	if matrixErr.ErrCode == ErrCodeUnrecognized {
+		return true
+	}
+	return matrixErr.ErrCode == "" && (matrixErr.StatusCode == http.StatusNotFound || matrixErr.StatusCode == http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package matrix
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	msc2946Feature = "org.matrix.msc2946"
+
+	// supportRetryInterval is how long to wait before asking the homeserver what it
+	// supports again, after failing to
+	supportRetryInterval = 30 * time.Second
+)
+
+type versionsResponse struct {
+	Versions         []string        `json:"versions"`
+	UnstableFeatures map[string]bool `json:"unstable_features"`
+}
+
+// serverSupport is what the homeserver said it supports in /versions.
+type serverSupport struct {
+	// v3 is true if the homeserver supports the v3 client-server API paths (Matrix 1.1)
+	v3 bool
+
+	// stableHierarchy is true if the homeserver supports /v1/hierarchy (Matrix 1.2)
+	stableHierarchy bool
+
+	// unstableHierarchy is true if the homeserver advertises MSC2946's unstable hierarchy
+	unstableHierarchy bool
+
+	// authenticatedMedia is true if the homeserver supports /v1/media (Matrix 1.11)
+	authenticatedMedia bool
+}
+
+// support returns what the homeserver supports, asking it the first time. If the
+// homeserver can't be asked, the most widely supported options are assumed until it is
+// asked again after supportRetryInterval. The lock isn't held while asking, so calls
+// made meanwhile may ask too rather than waiting on a slow homeserver.
+func (c *Client) support(ctx context.Context) *serverSupport {
+	c.supportLock.Lock()
+	supported, failedAt := c.supported, c.supportFailedAt
+	c.supportLock.Unlock()
+	if supported != nil {
+		return supported
+	}
+	if time.Since(failedAt) < supportRetryInterval {
+		return &serverSupport{}
+	}
+
+	j := versionsResponse{}
+	err := c.doRequest(ctx, "matrix.GetVersions", "GET", "/_matrix/client/versions", nil, &j)
+	if err != nil {
+		logrus.Warn("Unable to check which API versions the homeserver supports, assuming r0: ", err)
+		c.supportLock.Lock()
+		c.supportFailedAt = time.Now()
+		c.supportLock.Unlock()
+		return &serverSupport{}
+	}
+
+	s := &serverSupport{
+		unstableHierarchy: j.UnstableFeatures[msc2946Feature],
+	}
+	for _, v := range j.Versions {
+		minor, ok := specMinorVersion(v)
+		if !ok {
+			continue
+		}
+		if minor >= 1 {
+			s.v3 = true
+		}
+		if minor >= 2 {
+			s.stableHierarchy = true
+		}
+		if minor >= 11 {
+			s.authenticatedMedia = true
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"versions":            j.Versions,
+		"v3":                  s.v3,
+		"stable_hierarchy":    s.stableHierarchy,
+		"unstable_hierarchy":  s.unstableHierarchy,
+		"authenticated_media": s.authenticatedMedia,
+	}).Info("Negotiated homeserver API versions")
+	c.supportLock.Lock()
+	c.supported = s
+	c.supportLock.Unlock()
+	return s
+}
+
+// clientPath prefixes the given path with the newest client-server API version the
+// homeserver supports.
+func (c *Client) clientPath(ctx context.Context, path string) string {
+	if c.support(ctx).v3 {
+		return "/_matrix/client/v3" + path
+	}
+	return "/_matrix/client/r0" + path
+}
+
+// mediaPath prefixes the given path with the newest media API the homeserver supports.
+// Servers with authenticated media may refuse to serve newer media over the old API.
+func (c *Client) mediaPath(ctx context.Context, path string) string {
+	s := c.support(ctx)
+	if s.authenticatedMedia {
+		return "/_matrix/client/v1/media" + path
+	}
+	if s.v3 {
+		return "/_matrix/media/v3" + path
+	}
+	return "/_matrix/media/r0" + path
+}
+
+// specMinorVersion parses a "v1.x" spec version, returning x. Older "r0.x.y" versions
+// are not parsed.
+func specMinorVersion(v string) (int, bool) {
+	if !strings.HasPrefix(v, "v1.") {
+		return 0, false
+	}
+	minor, err := strconv.Atoi(strings.TrimPrefix(v, "v1."))
+	if err != nil {
+		return 0, false
+	}
+	return minor, true
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "directory"
+
+var HttpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "http_requests_total",
+	Help:      "Number of HTTP requests handled, by route action and status code",
+}, []string{"action", "method", "status"})
+
+var HttpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "http_request_duration_seconds",
+	Help:      "Time taken to handle HTTP requests, by route action",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"action"})
+
+var KeyServerAuth = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "key_server_auth_total",
+	Help:      "Number of requests authenticated through the key server, by outcome (success, rejected, error)",
+}, []string{"outcome"})
+
+var KeyServerDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "key_server_auth_duration_seconds",
+	Help:      "Time taken for the key server to authenticate a request",
+	Buckets:   prometheus.DefBuckets,
+})
+
+var HierarchyFetchDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "hierarchy_fetch_duration_seconds",
+	Help:      "Time taken to fetch the space hierarchy from the homeserver",
+	Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+})
+
+var HierarchyFetchFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "hierarchy_fetch_failures_total",
+	Help:      "Number of times fetching the space hierarchy failed",
+})
+
+var DirectorySize = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "rooms",
+	Help:      "Number of rooms in the directory",
+})
+
+var FederationRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "federation_requests_total",
+	Help:      "Number of authenticated federation requests, by origin server",
+}, []string{"origin"})
+
+var snapshotUnixMillis int64
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "snapshot_age_seconds",
+	Help:      "Time since the directory was last successfully refreshed",
+}, func() float64 {
+	ts := atomic.LoadInt64(&snapshotUnixMillis)
+	if ts == 0 {
+		return 0
+	}
+	return time.Since(time.UnixMilli(ts)).Seconds()
+})
+
+// SetSnapshotTime records when the directory was last refreshed, for the snapshot age.
+func SetSnapshotTime(ts time.Time) {
+	atomic.StoreInt64(&snapshotUnixMillis, ts.UnixMilli())
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/namsral/flag"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/appservice"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+// fillRegistrationTokens generates whichever appservice tokens aren't configured yet, so
+// a registration can be generated before the tokens are in the config.
+func fillRegistrationTokens(c *config.Config) {
+	if c.Appservice.AsToken == "" {
+		c.Appservice.AsToken = util.RandomString(32)
+		logrus.Warn("Generated a new as_token: copy it into the appservice section of your config")
+	}
+	if c.Appservice.HsToken == "" {
+		c.Appservice.HsToken = util.RandomString(32)
+		logrus.Warn("Generated a new hs_token: copy it into the appservice section of your config")
+	}
+}
+
+// runGenerateRegistration handles the `generate-registration` subcommand, writing the
+// appservice registration to give to the homeserver.
+func runGenerateRegistration(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("generate-registration", flag.ExitOnError)
+	outputPath := flags.String("output", "", "File to write the registration to. Defaults to stdout.")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *outputPath != "" {
+		f, err := os.Create(*outputPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return appservice.NewRegistration(cfg.Appservice).Write(out)
+}
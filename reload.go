@@ -0,0 +1,85 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+)
+
+// watchForReload reloads the config file whenever the process receives SIGHUP.
+func watchForReload(dir *directory.Service) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			reloadConfig(dir)
+		}
+	}()
+}
+
+func reloadConfig(dir *directory.Service) {
+	logrus.Info("Reloading config...")
+	next, err := config.Load(*configPath, applyFlags)
+	if err != nil {
+		logrus.Error("Not reloading config: ", err)
+		return
+	}
+
+	// Resolve a new space before applying anything, so that if it fails the old space is
+	// kept in the config and the next reload tries again.
+	spaceId := ""
+	if next.Space != config.Get().Space {
+		spaceId, err = dir.Client().ResolveRoom(context.Background(), next.Space)
+		if err != nil {
+			logrus.Error("Error resolving new space, keeping the old one: ", err)
+			next.Space = config.Get().Space
+		}
+	}
+
+	previous, ignored := config.ApplyReload(next)
+	for _, name := range ignored {
+		logrus.Warnf("Config section %q changed but requires a restart to take effect", name)
+	}
+
+	current := config.Get()
+	if current.Logging.Level != previous.Logging.Level {
+		lvl, _ := logrus.ParseLevel(current.Logging.Level)
+		logrus.SetLevel(lvl)
+	}
+
+	if current.Space != previous.Space {
+		dir.Configure(spaceId, current.UpdateSpaceOnUpgrade)
+		logrus.Info("Space ID (revised): ", spaceId)
+
+		err = dir.DoUpdate()
+		if err != nil {
+			logrus.Error("Error updating cache: ", err)
+		}
+	} else if current.UpdateSpaceOnUpgrade != previous.UpdateSpaceOnUpgrade {
+		dir.Configure(dir.SpaceId(), current.UpdateSpaceOnUpgrade)
+	}
+
+	logrus.Info("Config reloaded")
+}
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package search
+
+import (
+	"sort"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+// FuzzySearch matches the query against room names and aliases while tolerating typos.
+// A room matches if every query token is within maxEdits edits of a word in its name or
+// alias, or if the trigram similarity of the whole query and the room's name or alias is
+// at least minSimilarity. Results are ordered best match first.
+func (i *Index) FuzzySearch(query string, maxEdits int, minSimilarity float64) []*models.PublicRoomEntry {
+	scores := make(map[int]float64)
+
+	tokens := Tokenise(query)
+	if len(tokens) > 0 && maxEdits > 0 {
+		var editScores map[int]float64
+		for _, token := range tokens {
+			tokenScores := i.scoreFuzzyToken(token, maxEdits)
+			if editScores == nil {
+				editScores = tokenScores
+				continue
+			}
+			for doc, score := range editScores {
+				if s, ok := tokenScores[doc]; ok {
+					editScores[doc] = score + s
+				} else {
+					delete(editScores, doc)
+				}
+			}
+		}
+		for doc, score := range editScores {
+			scores[doc] = score / float64(len(tokens))
+		}
+	}
+
+	if minSimilarity > 0 {
+		for doc, similarity := range i.trigramSimilarity(query) {
+			if similarity < minSimilarity {
+				continue
+			}
+			if score := similarity * nameWeight; score > scores[doc] {
+				scores[doc] = score
+			}
+		}
+	}
+
+	docs := make([]int, 0, len(scores))
+	for doc := range scores {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(a int, b int) bool {
+		if scores[docs[a]] != scores[docs[b]] {
+			return scores[docs[a]] > scores[docs[b]]
+		}
+		return docs[a] < docs[b]
+	})
+
+	results := make([]*models.PublicRoomEntry, len(docs))
+	for n, doc := range docs {
+		results[n] = i.rooms[doc]
+	}
+	return results
+}
+
+func (i *Index) scoreFuzzyToken(token string, maxEdits int) map[int]float64 {
+	scores := make(map[int]float64)
+
+	allowed := allowedEdits(token, maxEdits)
+	tokenRunes := []rune(token)
+	for _, term := range i.nameTerms {
+		termRunes := []rune(term)
+		if abs(len(termRunes)-len(tokenRunes)) > allowed {
+			continue
+		}
+
+		distance := editDistance(tokenRunes, termRunes)
+		if distance > allowed {
+			continue
+		}
+
+		multiplier := 1.0 - float64(distance)/float64(len(tokenRunes)+1)
+		for _, p := range i.namePostings[term] {
+			score := p.weight * multiplier
+			if score > scores[p.doc] {
+				scores[p.doc] = score
+			}
+		}
+	}
+
+	return scores
+}
+
+// allowedEdits scales the edit tolerance with the length of the token, as a couple of
+// typos in a three letter word would match almost anything.
+func allowedEdits(token string, maxEdits int) int {
+	n := len([]rune(token))
+	allowed := maxEdits
+	if n <= 2 {
+		allowed = 0
+	} else if n <= 5 {
+		allowed = 1
+	}
+	if allowed > maxEdits {
+		allowed = maxEdits
+	}
+	return allowed
+}
+
+// editDistance returns the optimal string alignment distance between a and b: the
+// Levenshtein distance, but counting a transposition of adjacent runes as one edit.
+func editDistance(a []rune, b []rune) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minOf(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = minOf(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+
+	return prev[len(b)]
+}
+
+// trigramSimilarity returns the Jaccard similarity between the trigrams of the query and
+// those of each room's name or alias, whichever is higher.
+func (i *Index) trigramSimilarity(query string) map[int]float64 {
+	queryTrigrams := trigrams(query)
+	if len(queryTrigrams) == 0 {
+		return nil
+	}
+
+	// Names and aliases are indexed separately, so the key is twice the document
+	shared := make(map[int]int)
+	for t := range queryTrigrams {
+		for _, key := range i.trigramPostings[t] {
+			shared[key]++
+		}
+	}
+
+	result := make(map[int]float64)
+	for key, n := range shared {
+		doc := key / 2
+		similarity := float64(n) / float64(len(queryTrigrams)+i.trigramCounts[key]-n)
+		if similarity > result[doc] {
+			result[doc] = similarity
+		}
+	}
+	return result
+}
+
+// trigrams returns the set of three rune sequences in the normalised words of the text,
+// with each word padded so that short words and word boundaries are represented.
+func trigrams(text string) map[string]bool {
+	result := make(map[string]bool)
+	for _, word := range Tokenise(text) {
+		r := []rune("  " + word + " ")
+		for n := 0; n+3 <= len(r); n++ {
+			result[string(r[n:n+3])] = true
+		}
+	}
+	return result
+}
+
+func minOf(first int, rest ...int) int {
+	m := first
+	for _, v := range rest {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
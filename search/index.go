@@ -0,0 +1,192 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package search
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+const (
+	nameWeight  = 4.0
+	aliasWeight = 3.0
+	topicWeight = 1.0
+
+	// prefixPenalty is applied to terms which only match a query token by prefix
+	prefixPenalty = 0.5
+)
+
+type posting struct {
+	doc    int
+	weight float64
+}
+
+// Index is an immutable inverted index over a set of rooms. Build a new index rather
+// than modifying an existing one.
+type Index struct {
+	rooms    []*models.PublicRoomEntry
+	terms    []string
+	postings map[string][]posting
+
+	// Names and aliases are additionally indexed on their own for fuzzy matching
+	nameTerms       []string
+	namePostings    map[string][]posting
+	trigramPostings map[string][]int
+	trigramCounts   []int
+}
+
+// NewIndex indexes the name, canonical alias and topic of the given rooms. The order of
+// the rooms is used to break ties when ranking results.
+func NewIndex(rooms []*models.PublicRoomEntry) *Index {
+	idx := &Index{
+		rooms:           rooms,
+		postings:        make(map[string][]posting),
+		namePostings:    make(map[string][]posting),
+		trigramPostings: make(map[string][]int),
+		trigramCounts:   make([]int, len(rooms)*2),
+	}
+
+	for doc, r := range rooms {
+		alias := aliasLocalpart(r.CanonicalAlias)
+		nameWeights := make(map[string]float64)
+		addField(nameWeights, r.Name, nameWeight)
+		addField(nameWeights, alias, aliasWeight)
+		for term, weight := range nameWeights {
+			idx.namePostings[term] = append(idx.namePostings[term], posting{doc, weight})
+		}
+
+		weights := nameWeights
+		addField(weights, r.Topic, topicWeight)
+		for term, weight := range weights {
+			idx.postings[term] = append(idx.postings[term], posting{doc, weight})
+		}
+
+		for field, text := range []string{r.Name, alias} {
+			key := doc*2 + field
+			t := trigrams(text)
+			for trigram := range t {
+				idx.trigramPostings[trigram] = append(idx.trigramPostings[trigram], key)
+			}
+			idx.trigramCounts[key] = len(t)
+		}
+	}
+
+	idx.terms = sortedKeys(idx.postings)
+	idx.nameTerms = sortedKeys(idx.namePostings)
+
+	return idx
+}
+
+// aliasLocalpart returns the part of a room alias between the # and the server name.
+// The server name is left out of the index, as it would make every room with an alias
+// on a server like matrix.org match searches for "matrix".
+func aliasLocalpart(alias string) string {
+	alias = strings.TrimPrefix(alias, "#")
+	if i := strings.Index(alias, ":"); i >= 0 {
+		return alias[:i]
+	}
+	return alias
+}
+
+func sortedKeys(postings map[string][]posting) []string {
+	keys := make([]string, 0, len(postings))
+	for term := range postings {
+		keys = append(keys, term)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func addField(weights map[string]float64, text string, weight float64) {
+	seen := make(map[string]bool)
+	for _, term := range Tokenise(text) {
+		// Repeating a word within a field shouldn't make the room rank higher
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		weights[term] += weight
+	}
+}
+
+// Search returns the rooms matching every token in the query, most relevant first. Tokens
+// also match longer terms by prefix, though such matches score lower than exact ones.
+func (i *Index) Search(query string) []*models.PublicRoomEntry {
+	tokens := Tokenise(query)
+	if len(tokens) == 0 {
+		return i.rooms
+	}
+
+	var scores map[int]float64
+	for _, token := range tokens {
+		tokenScores := i.scoreToken(token)
+		if scores == nil {
+			scores = tokenScores
+			continue
+		}
+
+		// Rooms must match every token
+		for doc, score := range scores {
+			if s, ok := tokenScores[doc]; ok {
+				scores[doc] = score + s
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+
+	docs := make([]int, 0, len(scores))
+	for doc := range scores {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(a int, b int) bool {
+		if scores[docs[a]] != scores[docs[b]] {
+			return scores[docs[a]] > scores[docs[b]]
+		}
+		return docs[a] < docs[b]
+	})
+
+	results := make([]*models.PublicRoomEntry, len(docs))
+	for n, doc := range docs {
+		results[n] = i.rooms[doc]
+	}
+	return results
+}
+
+func (i *Index) scoreToken(token string) map[int]float64 {
+	scores := make(map[int]float64)
+
+	start := sort.SearchStrings(i.terms, token)
+	for n := start; n < len(i.terms) && strings.HasPrefix(i.terms[n], token); n++ {
+		term := i.terms[n]
+		multiplier := 1.0
+		if term != token {
+			multiplier = prefixPenalty * float64(len(token)) / float64(len(term))
+		}
+
+		for _, p := range i.postings[term] {
+			score := p.weight * multiplier
+			if score > scores[p.doc] {
+				scores[p.doc] = score
+			}
+		}
+	}
+
+	return scores
+}
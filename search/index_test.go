@@ -0,0 +1,267 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package search
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+const benchmarkRooms = 100000
+
+var benchmarkWords = []string{
+	"matrix", "element", "synapse", "dendrite", "conduit", "bridge", "discord", "irc",
+	"telegram", "linux", "gaming", "music", "café", "straße", "développeurs", "general",
+	"offtopic", "help", "support", "announcements", "community", "rust", "golang", "python",
+}
+
+func TestTokenise(t *testing.T) {
+	cases := []struct {
+		input    string
+		expected []string
+	}{
+		{"Café Society", []string{"cafe", "society"}},
+		{"CAFÉ", []string{"cafe"}},
+		{"Développeurs Français", []string{"developpeurs", "francais"}},
+		{"Ångström Æsir", []string{"angstrom", "æsir"}},
+		// Compatibility decomposition of ligatures and full width letters
+		{"ﬁsh ＡＢＣ", []string{"fish", "abc"}},
+		{"#matrix-hq:example.org", []string{"matrix", "hq", "example", "org"}},
+		{"  ", []string{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			actual := Tokenise(c.input)
+			if len(actual) == 0 && len(c.expected) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(actual, c.expected) {
+				t.Errorf("expected %q, got %q", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestSearchFoldsDiacritics(t *testing.T) {
+	idx := NewIndex([]*models.PublicRoomEntry{
+		{RoomID: "!cafe:example.org", Name: "Café Society"},
+		{RoomID: "!other:example.org", Name: "Tea Society"},
+	})
+
+	for _, query := range []string{"cafe", "CAFÉ", "café", "café"} {
+		assertRooms(t, query, idx.Search(query), "!cafe:example.org")
+	}
+}
+
+func TestSearchPrefix(t *testing.T) {
+	idx := NewIndex([]*models.PublicRoomEntry{
+		{RoomID: "!matrixhq:example.org", Name: "Matrix HQ"},
+		{RoomID: "!mat:example.org", Name: "Mat"},
+		{RoomID: "!topic:example.org", Name: "Off topic", Topic: "Not about mathematics"},
+		{RoomID: "!unrelated:example.org", Name: "Gardening"},
+	})
+
+	// Exact matches rank above prefix matches, and names above topics
+	assertRooms(t, "mat", idx.Search("mat"), "!mat:example.org", "!matrixhq:example.org", "!topic:example.org")
+	assertRooms(t, "matr", idx.Search("matr"), "!matrixhq:example.org")
+	// Every token has to match
+	assertRooms(t, "matrix h", idx.Search("matrix h"), "!matrixhq:example.org")
+	assertRooms(t, "matrix garden", idx.Search("matrix garden"))
+	// Prefixes of folded text match too
+	assertRooms(t, "MATRI", idx.Search("MATRI"), "!matrixhq:example.org")
+}
+
+func TestSearchIgnoresAliasServer(t *testing.T) {
+	idx := NewIndex([]*models.PublicRoomEntry{
+		{RoomID: "!foo:example.org", Name: "Foo", CanonicalAlias: "#foo-chat:matrix.org"},
+		{RoomID: "!hq:example.org", Name: "HQ", CanonicalAlias: "#matrix:example.org"},
+	})
+
+	assertRooms(t, "matrix", idx.Search("matrix"), "!hq:example.org")
+	assertRooms(t, "org", idx.Search("org"))
+	assertRooms(t, "chat", idx.Search("chat"), "!foo:example.org")
+	assertRooms(t, "matrx", idx.FuzzySearch("matrx", 2, 0.3), "!hq:example.org")
+}
+
+func TestSearchEmptyQuery(t *testing.T) {
+	rooms := []*models.PublicRoomEntry{
+		{RoomID: "!a:example.org", Name: "A"},
+		{RoomID: "!b:example.org", Name: "B"},
+	}
+	assertRooms(t, "", NewIndex(rooms).Search(" - "), "!a:example.org", "!b:example.org")
+}
+
+func TestEditDistance(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"matrix", "matrix", 0},
+		{"matirx", "matrix", 1}, // transposition
+		{"kubernets", "kubernetes", 1},
+		{"matrx", "matrix", 1},
+		{"matrixx", "matrix", 1},
+		{"natrix", "matrix", 1},
+		{"mtarix", "matrix", 1},
+		{"element", "elephant", 3},
+		{"", "abc", 3},
+		{"café", "cafe", 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.a+"/"+c.b, func(t *testing.T) {
+			if actual := editDistance([]rune(c.a), []rune(c.b)); actual != c.expected {
+				t.Errorf("expected %d, got %d", c.expected, actual)
+			}
+			if actual := editDistance([]rune(c.b), []rune(c.a)); actual != c.expected {
+				t.Errorf("reversed: expected %d, got %d", c.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAllowedEdits(t *testing.T) {
+	cases := []struct {
+		token    string
+		maxEdits int
+		expected int
+	}{
+		{"a", 2, 0},
+		{"ab", 2, 0},
+		{"abc", 2, 1},
+		{"abcde", 2, 1},
+		{"abcdef", 2, 2},
+		{"kubernets", 3, 3},
+		{"abcdef", 1, 1},
+		{"abc", 0, 0},
+		{"éèê", 2, 1}, // counted in runes, not bytes
+	}
+
+	for _, c := range cases {
+		t.Run(c.token, func(t *testing.T) {
+			if actual := allowedEdits(c.token, c.maxEdits); actual != c.expected {
+				t.Errorf("expected %d edits with a max of %d, got %d", c.expected, c.maxEdits, actual)
+			}
+		})
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	idx := NewIndex([]*models.PublicRoomEntry{
+		{RoomID: "!k8s:example.org", Name: "Kubernetes"},
+		{RoomID: "!matrix:example.org", Name: "Matrix HQ"},
+		{RoomID: "!mat:example.org", Name: "Mat"},
+		{RoomID: "!cat:example.org", Name: "Cat pictures"},
+		{RoomID: "!go:example.org", Name: "Go", CanonicalAlias: "#golang:example.org"},
+	})
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		// The examples from the original request
+		{"kubernets", []string{"!k8s:example.org"}},
+		{"matirx", []string{"!matrix:example.org"}},
+		{"MATIRX hq", []string{"!matrix:example.org"}},
+		// Aliases are matched too
+		{"golnag", []string{"!go:example.org"}},
+		// Short tokens only tolerate one typo, and one or two letter tokens none
+		{"mta", []string{"!mat:example.org"}},
+		{"mxx", nil},
+		{"og", nil},
+		{"kubrnts", nil},
+		// An exact match ranks above a fuzzy one
+		{"cat", []string{"!cat:example.org", "!mat:example.org"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.query, func(t *testing.T) {
+			assertRooms(t, c.query, idx.FuzzySearch(c.query, 2, 0), c.expected...)
+		})
+	}
+}
+
+func TestFuzzySearchTrigrams(t *testing.T) {
+	idx := NewIndex([]*models.PublicRoomEntry{
+		{RoomID: "!dev:example.org", Name: "Développeurs Matrix"},
+		{RoomID: "!other:example.org", Name: "Gardening"},
+	})
+
+	// Too many typos to be within the edit distance, but enough trigrams in common
+	assertRooms(t, "developers matrix", idx.FuzzySearch("developers matrix", 0, 0.3), "!dev:example.org")
+	assertRooms(t, "developers matrix", idx.FuzzySearch("developers matrix", 0, 0.9))
+	assertRooms(t, "unrelated", idx.FuzzySearch("xyz", 2, 0.3))
+}
+
+func assertRooms(t *testing.T, query string, results []*models.PublicRoomEntry, expected ...string) {
+	t.Helper()
+	actual := make([]string, len(results))
+	for n, r := range results {
+		actual[n] = r.RoomID
+	}
+	if len(actual) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%q: expected %q, got %q", query, expected, actual)
+	}
+}
+
+// benchmarkRoomList generates rooms with names, aliases and topics drawn from a small
+// vocabulary, so that searches match a realistic share of them.
+func benchmarkRoomList(n int) []*models.PublicRoomEntry {
+	rnd := rand.New(rand.NewSource(1))
+	word := func() string {
+		return benchmarkWords[rnd.Intn(len(benchmarkWords))]
+	}
+
+	rooms := make([]*models.PublicRoomEntry, n)
+	for i := range rooms {
+		rooms[i] = &models.PublicRoomEntry{
+			RoomID:         fmt.Sprintf("!room%d:example.org", i),
+			Name:           fmt.Sprintf("%s %s %d", word(), word(), i),
+			CanonicalAlias: fmt.Sprintf("#%s-%d:example.org", word(), i),
+			Topic:          fmt.Sprintf("A room about %s, %s and %s", word(), word(), word()),
+		}
+	}
+	return rooms
+}
+
+func BenchmarkNewIndex(b *testing.B) {
+	rooms := benchmarkRoomList(benchmarkRooms)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		NewIndex(rooms)
+	}
+}
+
+func BenchmarkSearch(b *testing.B) {
+	idx := NewIndex(benchmarkRoomList(benchmarkRooms))
+	for _, query := range []string{"matrix", "mat", "cafe bridge", "developpeurs", "nothing"} {
+		b.Run(query, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				idx.Search(query)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package search
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Tokenise splits text into normalised search terms. Text is decomposed, stripped of
+// diacritics and case folded so that "Café" and "cafe" produce the same term.
+func Tokenise(text string) []string {
+	normalised := Normalise(text)
+	return strings.FieldsFunc(normalised, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Normalise applies the same Unicode normalisation, diacritic and case folding as
+// Tokenise without splitting the text up.
+func Normalise(text string) string {
+	// Transformers are stateful, so a new chain is needed for each call
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC, cases.Fold())
+	s, _, err := transform.String(t, text)
+	if err != nil {
+		return strings.ToLower(text)
+	}
+	return s
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package submissions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/util"
+)
+
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+)
+
+// InvalidError is returned when a submission is refused, with a message which is safe to
+// show to the submitter.
+type InvalidError struct {
+	Message string
+}
+
+func (e *InvalidError) Error() string {
+	return e.Message
+}
+
+// Submission is a room proposed for the directory.
+type Submission struct {
+	Id     int64  `json:"id"`
+	RoomId string `json:"room_id"`
+	// Room is the alias or ID as it was submitted
+	Room      string `json:"room"`
+	Submitter string `json:"submitter,omitempty"`
+	Note      string `json:"note,omitempty"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	DecidedBy string `json:"decided_by,omitempty"`
+	CreatedTs int64  `json:"created_ts"`
+	DecidedTs int64  `json:"decided_ts,omitempty"`
+
+	// notifyRoomId is where to tell the submitter about the decision. If empty, the
+	// submitter is sent a direct message instead.
+	notifyRoomId string
+}
+
+// Service queues submissions for review, and adds approved rooms to the directory's space.
+type Service struct {
+	dir              *directory.Service
+	db               *sql.DB
+	managementRoomId string
+}
+
+// NewService creates a service which stores submissions in the database and tells
+// curators about them in the management room.
+func NewService(dir *directory.Service, db *sql.DB, managementRoomId string) *Service {
+	return &Service{
+		dir:              dir,
+		db:               db,
+		managementRoomId: managementRoomId,
+	}
+}
+
+// Submit validates a proposed room and queues it for review. The submitter is optional,
+// but must be a Matrix user ID if given. notifyRoomId is where to tell the submitter the
+// decision, or empty to send them a direct message.
+func (s *Service) Submit(ctx context.Context, room string, submitter string, note string, notifyRoomId string) (*Submission, error) {
+	if !strings.HasPrefix(room, "#") && !strings.HasPrefix(room, "!") {
+		return nil, &InvalidError{"room must be a room alias or room ID"}
+	}
+	if submitter != "" && (!strings.HasPrefix(submitter, "@") || !strings.Contains(submitter, ":")) {
+		return nil, &InvalidError{"submitter must be a Matrix user ID"}
+	}
+
+	client := s.dir.Client()
+	roomId, err := client.ResolveRoom(ctx, room)
+	if err != nil {
+		return nil, &InvalidError{fmt.Sprintf("%s could not be found", room)}
+	}
+	if s.dir.Current().Room(roomId) != nil {
+		return nil, &InvalidError{fmt.Sprintf("%s is already in the directory", room)}
+	}
+
+	summary, err := client.GetRoomSummary(ctx, roomId)
+	if err != nil {
+		logrus.WithField("room_id", roomId).Info("Unable to look up submitted room: ", err)
+		return nil, &InvalidError{fmt.Sprintf("%s could not be reached", room)}
+	}
+	if summary.JoinRule != "public" {
+		return nil, &InvalidError{fmt.Sprintf("%s is not public", room)}
+	}
+
+	sub := &Submission{
+		RoomId:       roomId,
+		Room:         room,
+		Submitter:    submitter,
+		Note:         note,
+		Status:       StatusPending,
+		CreatedTs:    time.Now().UnixMilli(),
+		notifyRoomId: notifyRoomId,
+	}
+	err = s.db.QueryRowContext(ctx,
+		"INSERT INTO room_submissions (room_id, room, submitter, notify_room_id, note, status, created_ts) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id;",
+		sub.RoomId, sub.Room, sub.Submitter, sub.notifyRoomId, sub.Note, sub.Status, sub.CreatedTs).Scan(&sub.Id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code.Name() == "unique_violation" {
+		return nil, &InvalidError{fmt.Sprintf("%s has already been submitted and is waiting for review", room)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"submission_id": sub.Id,
+		"room_id":       sub.RoomId,
+		"submitter":     sub.Submitter,
+	}).Info("Room submitted for the directory")
+
+	text := fmt.Sprintf("New submission #%d: %s (%s)", sub.Id, sub.Room, sub.RoomId)
+	if sub.Submitter != "" {
+		text += " from " + sub.Submitter
+	}
+	if sub.Note != "" {
+		text += ": " + sub.Note
+	}
+	s.notify(ctx, s.managementRoomId, text+"\nReview with !dir approve or !dir reject.")
+
+	return sub, nil
+}
+
+// Pending returns the submissions waiting for review, oldest first.
+func (s *Service) Pending(ctx context.Context) ([]*Submission, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, room_id, room, submitter, notify_room_id, note, status, reason, decided_by, created_ts, decided_ts FROM room_submissions WHERE status = $1 ORDER BY id ASC;", StatusPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := make([]*Submission, 0)
+	for rows.Next() {
+		sub, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		pending = append(pending, sub)
+	}
+	return pending, rows.Err()
+}
+
+// Get returns the submission with the given ID, or nil if there isn't one.
+func (s *Service) Get(ctx context.Context, id int64) (*Submission, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id, room_id, room, submitter, notify_room_id, note, status, reason, decided_by, created_ts, decided_ts FROM room_submissions WHERE id = $1;", id)
+	sub, err := scan(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return sub, err
+}
+
+// Approve adds the submitted room to the directory's space and tells the submitter. The
+// submission is marked approved first, so that a moderator rejecting it at the same time
+// can't end up with the room listed anyway.
+func (s *Service) Approve(ctx context.Context, id int64, moderator string) (*Submission, error) {
+	sub, err := s.pending(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.decide(ctx, sub, StatusApproved, moderator, "")
+	if err != nil {
+		return nil, err
+	}
+
+	via := util.ViaServers(sub.RoomId, sub.Room)
+	_, err = s.dir.UpdateSpaceChild(ctx, sub.RoomId, directory.SpaceChildUpdate{Via: via})
+	if err != nil {
+		s.undecide(ctx, sub)
+		return nil, err
+	}
+	s.dir.RequestUpdate()
+
+	s.notifySubmitter(ctx, sub, fmt.Sprintf("Your submission of %s to the room directory has been approved.", sub.Room))
+	return sub, nil
+}
+
+// Reject declines the submission and tells the submitter, including the reason if given.
+func (s *Service) Reject(ctx context.Context, id int64, moderator string, reason string) (*Submission, error) {
+	sub, err := s.pending(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.decide(ctx, sub, StatusRejected, moderator, reason)
+	if err != nil {
+		return nil, err
+	}
+
+	text := fmt.Sprintf("Your submission of %s to the room directory was not accepted.", sub.Room)
+	if reason != "" {
+		text += " Reason: " + reason
+	}
+	s.notifySubmitter(ctx, sub, text)
+	return sub, nil
+}
+
+func (s *Service) pending(ctx context.Context, id int64) (*Submission, error) {
+	sub, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if sub == nil {
+		return nil, &InvalidError{fmt.Sprintf("there is no submission #%d", id)}
+	}
+	if sub.Status != StatusPending {
+		return nil, &InvalidError{fmt.Sprintf("submission #%d has already been %s", id, sub.Status)}
+	}
+	return sub, nil
+}
+
+func (s *Service) decide(ctx context.Context, sub *Submission, status string, moderator string, reason string) error {
+	sub.Status = status
+	sub.DecidedBy = moderator
+	sub.Reason = reason
+	sub.DecidedTs = time.Now().UnixMilli()
+
+	res, err := s.db.ExecContext(ctx,
+		"UPDATE room_submissions SET status = $2, decided_by = $3, reason = $4, decided_ts = $5 WHERE id = $1 AND status = $6;",
+		sub.Id, sub.Status, sub.DecidedBy, sub.Reason, sub.DecidedTs, StatusPending)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return &InvalidError{fmt.Sprintf("submission #%d was decided by someone else first", sub.Id)}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"submission_id": sub.Id,
+		"room_id":       sub.RoomId,
+		"moderator":     moderator,
+	}).Infof("Submission %s", status)
+	return nil
+}
+
+// undecide puts a submission back to pending after its approval couldn't be carried out,
+// so that it can be approved again.
+func (s *Service) undecide(ctx context.Context, sub *Submission) {
+	_, err := s.db.ExecContext(ctx,
+		"UPDATE room_submissions SET status = $2, decided_by = '', reason = '', decided_ts = 0 WHERE id = $1 AND status = $3;",
+		sub.Id, StatusPending, sub.Status)
+	if err != nil {
+		logrus.WithField("submission_id", sub.Id).Error("Error returning submission to pending: ", err)
+		return
+	}
+	sub.Status = StatusPending
+	sub.DecidedBy = ""
+	sub.Reason = ""
+	sub.DecidedTs = 0
+}
+
+// notifySubmitter tells the submitter about a decision where they submitted the room,
+// or in a new direct message if they submitted it over HTTP.
+func (s *Service) notifySubmitter(ctx context.Context, sub *Submission, text string) {
+	if sub.Submitter == "" {
+		return
+	}
+
+	roomId := sub.notifyRoomId
+	if roomId == "" {
+		var err error
+		roomId, err = s.dir.Client().CreateDirectRoom(ctx, sub.Submitter)
+		if err != nil {
+			logrus.WithField("submitter", sub.Submitter).Error("Error creating room to notify submitter: ", err)
+			return
+		}
+	} else {
+		text = sub.Submitter + ": " + text
+	}
+	s.notify(ctx, roomId, text)
+}
+
+func (s *Service) notify(ctx context.Context, roomId string, text string) {
+	err := s.dir.Client().SendNotice(ctx, roomId, text)
+	if err != nil {
+		logrus.WithField("room_id", roomId).Error("Error sending submission notice: ", err)
+	}
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scan(row scanner) (*Submission, error) {
+	sub := &Submission{}
+	err := row.Scan(&sub.Id, &sub.RoomId, &sub.Room, &sub.Submitter, &sub.notifyRoomId, &sub.Note, &sub.Status, &sub.Reason, &sub.DecidedBy, &sub.CreatedTs, &sub.DecidedTs)
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
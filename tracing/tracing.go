@@ -0,0 +1,115 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterNone   = ""
+	ExporterOtlp   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+const instrumentationName = "github.com/t2bot/matrix-room-directory-server"
+
+// Setup installs the global tracer provider and W3C trace context propagation. Spans are
+// sent to an OTLP/HTTP collector at otlpEndpoint (such as http://localhost:4318) or
+// printed, depending on the exporter. The returned function flushes any pending spans and
+// should be called before exiting.
+func Setup(exporter string, otlpEndpoint string) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return func(ctx context.Context) error { return nil }, nil
+	case ExporterStdout:
+		// Despite the name, spans go to stderr so that they don't end up in exports
+		// written to stdout
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case ExporterOtlp:
+		opts := make([]otlptracehttp.Option, 0)
+		if otlpEndpoint != "" {
+			u, err := url.Parse(otlpEndpoint)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithEndpoint(u.Host))
+			if u.Scheme == "http" {
+				opts = append(opts, otlptracehttp.WithInsecure())
+			}
+			if u.Path != "" && u.Path != "/" {
+				opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+			}
+		}
+		spanExporter, err = otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, errors.New("unknown trace exporter: " + exporter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("matrix-room-directory-server"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span using the global tracer provider.
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// Extract returns a context carrying the trace context from incoming request headers.
+func Extract(ctx context.Context, headers http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(headers))
+}
+
+// Inject adds the trace context of ctx to outgoing request headers.
+func Inject(ctx context.Context, headers http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(headers))
+}
+
+// EndSpan records err on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
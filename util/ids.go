@@ -0,0 +1,52 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"strings"
+)
+
+// ServerName returns the server name part of a Matrix ID, such as example.org for
+// #room:example.org. It returns an empty string if the ID doesn't have one, as with
+// room IDs from room version 12 onwards.
+func ServerName(id string) string {
+	i := strings.Index(id, ":")
+	if i < 0 {
+		return ""
+	}
+	return id[i+1:]
+}
+
+// ViaServers returns the distinct server names of the given IDs, in order, skipping any
+// IDs without one.
+func ViaServers(ids ...string) []string {
+	via := make([]string, 0, len(ids))
+	for _, id := range ids {
+		server := ServerName(id)
+		if server == "" {
+			continue
+		}
+		duplicate := false
+		for _, v := range via {
+			duplicate = duplicate || v == server
+		}
+		if !duplicate {
+			via = append(via, server)
+		}
+	}
+	return via
+}
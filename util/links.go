@@ -0,0 +1,56 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+// MatrixToLink returns a matrix.to link for joining the room, preferring its alias.
+func MatrixToLink(room *models.PublicRoomEntry) string {
+	if room.CanonicalAlias != "" {
+		return "https://matrix.to/#/" + room.CanonicalAlias
+	}
+	return "https://matrix.to/#/" + room.RoomID
+}
+
+// ThumbnailPath converts an mxc:// URI to the path of a square thumbnail proxied by this
+// server, returning an empty string if the URI is not valid. Browsers can't fetch media
+// from the homeserver directly, as it needs an access token.
+func ThumbnailPath(mxc string, size int) string {
+	server, mediaId, ok := ParseMxc(mxc)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("/thumbnails/%s/%s?size=%d", url.PathEscape(server), url.PathEscape(mediaId), size)
+}
+
+// ParseMxc splits an mxc:// URI into its server name and media ID.
+func ParseMxc(mxc string) (string, string, bool) {
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return "", "", false
+	}
+	parts := strings.SplitN(mxc[len("mxc://"):], "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -22,3 +22,10 @@ func Min(a int, b int) int {
 	}
 	return a
 }
+
+func Max(a int, b int) int {
+	if a < b {
+		return b
+	}
+	return a
+}
@@ -1,5 +1,5 @@
 /*
- * Copyright 2019 - 2022 Travis Ralston <travis@t2bot.io>
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
  *
  * Licensed under the Apache License, Version 2.0 (the "License");
  * you may not use this file except in compliance with the License.
@@ -14,8 +14,19 @@
  * limitations under the License.
  */
 
-package common
+package util
 
-var AccessToken string
-var HomeserverUrl string
-var SpaceId string
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// RandomString returns a hex string made from the given number of random bytes.
+func RandomString(nBytes int) string {
+	b := make([]byte, nBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
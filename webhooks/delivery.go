@@ -0,0 +1,191 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhooks
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/database"
+)
+
+const (
+	maxAttempts  = 10
+	baseBackoff  = 10 * time.Second
+	maxBackoff   = 1 * time.Hour
+	pollInterval = 30 * time.Second
+	batchSize    = 50
+	sendTimeout  = 15 * time.Second
+
+	// claimLease is long enough to send a whole batch, even if every target times out
+	claimLease = batchSize*sendTimeout + 5*time.Minute
+)
+
+var client = &http.Client{Timeout: sendTimeout}
+
+var wake = make(chan bool, 1)
+var stopChan = make(chan bool)
+
+type delivery struct {
+	id       int64
+	target   string
+	payload  []byte
+	attempts int
+}
+
+// BeginDelivering starts sending queued webhooks in the background, including any left
+// over from a previous run.
+func BeginDelivering() {
+	ticker := time.NewTicker(pollInterval)
+
+	go func() {
+		defer close(stopChan)
+		for {
+			deliverDue()
+			select {
+			case <-stopChan:
+				ticker.Stop()
+				return
+			case <-ticker.C:
+			case <-wake:
+			}
+		}
+	}()
+}
+
+func Stop() {
+	stopChan <- true
+}
+
+// deliverDue claims a batch of due deliveries and sends them. Claiming pushes their next
+// attempt back by claimLease, so that other instances sharing the database skip them. If
+// this instance dies mid-batch, they become due again once the lease runs out.
+func deliverDue() {
+	now := time.Now()
+	rows, err := database.Get().Query(
+		"UPDATE webhook_deliveries SET next_attempt_ts = $2 WHERE id IN (SELECT id FROM webhook_deliveries WHERE status = 'pending' AND next_attempt_ts <= $1 ORDER BY id ASC LIMIT $3 FOR UPDATE SKIP LOCKED) RETURNING id, target_url, payload, attempts;",
+		now.UnixMilli(), now.Add(claimLease).UnixMilli(), batchSize)
+	if err != nil {
+		logrus.Error("Error loading webhook queue: ", err)
+		return
+	}
+
+	due := make([]*delivery, 0)
+	for rows.Next() {
+		d := &delivery{}
+		err = rows.Scan(&d.id, &d.target, &d.payload, &d.attempts)
+		if err != nil {
+			rows.Close()
+			logrus.Error("Error loading webhook queue: ", err)
+			return
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+
+	// RETURNING doesn't keep the subquery's order
+	sort.Slice(due, func(i int, j int) bool {
+		return due[i].id < due[j].id
+	})
+	for _, d := range due {
+		deliver(d)
+	}
+}
+
+func deliver(d *delivery) {
+	log := logrus.WithFields(logrus.Fields{
+		"delivery_id": d.id,
+		"target":      d.target,
+	})
+
+	d.attempts++
+	start := time.Now()
+	statusCode, err := send(d)
+	duration := time.Since(start)
+
+	errMessage := ""
+	if err != nil {
+		errMessage = err.Error()
+	}
+	_, dbErr := database.Get().Exec(
+		"INSERT INTO webhook_delivery_log (delivery_id, attempt, status_code, error, duration_ms, attempt_ts) VALUES ($1, $2, $3, $4, $5, $6);",
+		d.id, d.attempts, statusCode, errMessage, duration.Milliseconds(), start.UnixMilli())
+	if dbErr != nil {
+		log.Error("Error recording webhook attempt: ", dbErr)
+	}
+
+	status := "pending"
+	nextAttempt := time.Now().Add(backoff(d.attempts))
+	if err == nil {
+		status = "delivered"
+		log.Info("Delivered webhook")
+	} else if d.attempts >= maxAttempts {
+		status = "failed"
+		log.Error("Giving up on webhook: ", err)
+	} else {
+		log.Warnf("Error delivering webhook, retrying at %s: %v", nextAttempt.Format(time.RFC3339), err)
+	}
+
+	_, dbErr = database.Get().Exec(
+		"UPDATE webhook_deliveries SET status = $2, attempts = $3, next_attempt_ts = $4 WHERE id = $1;",
+		d.id, status, d.attempts, nextAttempt.UnixMilli())
+	if dbErr != nil {
+		log.Error("Error updating webhook delivery: ", dbErr)
+	}
+}
+
+func send(d *delivery) (int, error) {
+	req, err := http.NewRequest("POST", d.target, bytes.NewBuffer(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "matrix-room-directory-server")
+	if secret := config.Get().Webhooks.Secret; secret != "" {
+		req.Header.Set(SignatureHeader, sign(secret, d.payload))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// backoff doubles the delay for each failed attempt, with up to 20% jitter so a
+// recovering target isn't hit by every delivery at once.
+func backoff(attempts int) time.Duration {
+	delay := baseBackoff << (attempts - 1)
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/5)+1))
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2022 Travis Ralston <travis@t2bot.io>
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/t2bot/matrix-room-directory-server/config"
+	"github.com/t2bot/matrix-room-directory-server/database"
+	"github.com/t2bot/matrix-room-directory-server/directory"
+	"github.com/t2bot/matrix-room-directory-server/models"
+)
+
+// SignatureHeader carries the hex-encoded HMAC-SHA256 of the request body, keyed with
+// the webhook secret and prefixed with "sha256=". It is left out if there is no secret.
+const SignatureHeader = "X-Directory-Signature"
+
+type Payload struct {
+	Type      string                  `json:"type"`
+	Timestamp int64                   `json:"timestamp"`
+	Room      *models.PublicRoomEntry `json:"room"`
+	Previous  *models.PublicRoomEntry `json:"previous,omitempty"`
+}
+
+// Setup starts queueing a webhook to each configured target for every change to the
+// directory. A database must be configured, as deliveries are queued there until they
+// succeed. Targets are read from the config for each change, so they can be reloaded.
+func Setup(dir *directory.Service) {
+	dir.OnChanges(enqueue)
+}
+
+func enqueue(changes []*directory.Change) {
+	targets := config.Get().Webhooks.Urls
+	if len(targets) == 0 {
+		return
+	}
+
+	now := time.Now().UnixMilli()
+	for _, c := range changes {
+		payload := &Payload{
+			Type:      "room." + string(c.Type),
+			Timestamp: c.Timestamp.UnixMilli(),
+			Room:      c.Room,
+			Previous:  c.Previous,
+		}
+		b, err := json.Marshal(payload)
+		if err != nil {
+			logrus.Error("Error encoding webhook payload: ", err)
+			continue
+		}
+
+		for _, target := range targets {
+			_, err = database.Get().Exec(
+				"INSERT INTO webhook_deliveries (target_url, event_type, payload, status, attempts, next_attempt_ts, created_ts) VALUES ($1, $2, $3, 'pending', 0, $4, $4);",
+				target, payload.Type, b, now)
+			if err != nil {
+				logrus.WithField("target", target).Error("Error queueing webhook: ", err)
+			}
+		}
+	}
+
+	// Deliver straight away rather than waiting for the next poll
+	select {
+	case wake <- true:
+	default:
+	}
+}
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}